@@ -3,6 +3,7 @@ module live
 go 1.14
 
 require (
+	github.com/andybalholm/brotli v1.0.0
 	github.com/gin-gonic/gin v1.6.3
 	github.com/gorilla/websocket v1.4.2
 	github.com/markbates/pkger v0.17.0
@@ -0,0 +1,537 @@
+package platform
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"live/util"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+const (
+	AcfunBaseUrl      = "https://live.acfun.cn/live/%s"
+	AcfunLoginUrl     = "https://id.app.acfun.cn/rest/app/visitor/login"
+	AcfunPlayUrl      = "https://api.kuaishouzt.com/rest/zt/live/web/startPlay?subBiz=mainApp&kpn=ACFUN_APP&kpf=PC_WEB&userId=%d&did=%s&acfun.api.visitor_st=%s"
+	AcfunDanmakuUrl   = "wss://klink-newproduct-ws3.kwaizt.com/"
+	AcfunAppID        = 13
+	AcfunKpn          = "ACFUN_APP"
+	AcfunKpf          = "PC_WEB"
+	AcfunSubBiz       = "mainApp"
+	AcfunSdkVersion   = "kwai-acfun-live-link"
+	AcfunLinkVersion  = "2.13.8"
+	AcfunPacketMagic  = 0xabcd0001
+	AcfunHeartbeatGap = time.Second * 10
+)
+
+// commands of kwai link
+const (
+	ACFUN_CMD_REGISTER   = "Basic.Register"
+	ACFUN_CMD_KEEP_ALIVE = "Basic.KeepAlive"
+	ACFUN_CMD_CS         = "Global.ZtLiveInteractive.CsCmd"
+	ACFUN_CMD_PUSH       = "Push.ZtLiveInteractive.Message"
+	ACFUN_CS_ENTER_ROOM  = "ZtLiveCsEnterRoom"
+	ACFUN_CS_HEARTBEAT   = "ZtLiveCsHeartbeat"
+	ACFUN_SC_SIGNAL      = "ZtLiveScActionSignal"
+	ACFUN_SIGNAL_COMMENT = "CommonActionSignalComment"
+)
+
+// encryption modes of packet header
+const (
+	ACFUN_ENCRYPTION_NONE          = 0
+	ACFUN_ENCRYPTION_SERVICE_TOKEN = 1
+	ACFUN_ENCRYPTION_SESSION_KEY   = 2
+	ACFUN_COMPRESSION_GZIP         = 2
+)
+
+const ACFUN Type = 8
+
+var AcfunRoomUrlRe = regexp.MustCompile(`^(?:live|m)\.acfun\.cn/live/(?:detail/)?(\d+)`)
+
+func init() {
+	Register(&Adapter{
+		Type:         ACFUN,
+		Name:         "acfun",
+		Capabilities: Capabilities{Danmaku: true},
+		URL:          AcfunRoomUrlRe,
+		New:          GetAcfunRoom,
+	})
+}
+
+type Acfun struct {
+	*BaseRoom
+	RoomID  string
+	Quality uint
+	Status  int
+	Dan     *websocket.Conn
+	// visitor login
+	userID      int64
+	did         string
+	visitorSt   string
+	securityKey []byte
+	// startPlay result
+	play gjson.Result
+	// kwai link session
+	sessionKey []byte
+	instanceID int64
+	seqID      int64
+	// acks are written by heartbeat, websocket supports only one writer
+	ack chan []byte
+}
+
+// login logs in as visitor, visitor token is enough for stream and danmaku
+func (a *Acfun) login() error {
+	cookies, err := util.Cookies(fmt.Sprintf(AcfunBaseUrl, a.RoomID), nil)
+	if err != nil {
+		return err
+	}
+	for _, cookie := range cookies {
+		if cookie.Name == "_did" {
+			a.did = cookie.Value
+		}
+	}
+	if a.did == "" {
+		return errors.New("acfun did not found")
+	}
+	res, err := util.Request("POST", AcfunLoginUrl, "sid=acfun.api.visitor", map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+		"Cookie":       "_did=" + a.did,
+	})
+	if err != nil {
+		return err
+	}
+	data := gjson.ParseBytes(res)
+	if data.Get("result").Int() != 0 {
+		return errors.New(fmt.Sprintf("acfun visitor login failed: %s", data.Get("error_msg").String()))
+	}
+	a.userID = data.Get("userId").Int()
+	a.visitorSt = data.Get("acfun\\.api\\.visitor_st").String()
+	a.securityKey, err = base64.StdEncoding.DecodeString(data.Get("acSecurity").String())
+	return err
+}
+
+// startPlay gets stream and danmaku tickets, it fails if the room is not living
+func (a *Acfun) startPlay() (bool, error) {
+	res, err := util.Request("POST",
+		fmt.Sprintf(AcfunPlayUrl, a.userID, url.QueryEscape(a.did), url.QueryEscape(a.visitorSt)),
+		"authorId="+url.QueryEscape(a.RoomID)+"&pullStreamType=FLV",
+		map[string]string{
+			"Content-Type": "application/x-www-form-urlencoded",
+			"Referer":      "https://live.acfun.cn/",
+			"Cookie":       "_did=" + a.did,
+		})
+	if err != nil {
+		return false, err
+	}
+	data := gjson.ParseBytes(res)
+	if data.Get("result").Int() != 1 {
+		logger.Debugf("acfun room %s start play: %s", a.RoomID, data.Get("error_msg").String())
+		return false, nil
+	}
+	a.play = data.Get("data")
+	return true, nil
+}
+
+func GetAcfunRoom(id string, quality uint, client *websocket.Conn) (Room, error) {
+	room := &Acfun{
+		RoomID:  id,
+		Quality: quality,
+	}
+	err := room.login()
+	if err != nil {
+		return nil, err
+	}
+	living, err := room.startPlay()
+	if err != nil {
+		return nil, err
+	}
+	if living {
+		room.Status = 1
+	}
+	if client == nil {
+		return room, nil
+	}
+	if !living {
+		return nil, errors.New(fmt.Sprintf("room %s is not living", id))
+	}
+	return joinRoom(roomIndex(ACFUN, id), func() Room {
+		_room := *room
+		_room.BaseRoom = newBaseRoom(ACFUN, id, &_room)
+		return &_room
+	}, client), nil
+}
+
+func (a *Acfun) GetLiveInfo() (*Platform, error) {
+	if a.Status != 1 {
+		return &Platform{
+			Type:           ACFUN,
+			RoomID:         a.RoomID,
+			Status:         0,
+			CurrentQuality: a.Quality,
+		}, nil
+	}
+	// quality is the bitrate of representation, the highest one is the default
+	manifest := gjson.Parse(a.play.Get("videoPlayRes").String())
+	var qualities []Quality
+	var link, bestLink string
+	var best uint64
+	manifest.Get("liveAdaptiveManifest.0.adaptationSet.representation").ForEach(func(key, value gjson.Result) bool {
+		bitrate := value.Get("bitrate").Uint()
+		qualities = append(qualities, Quality{
+			Quality:     bitrate,
+			Description: value.Get("name").String(),
+		})
+		if bitrate >= best {
+			best = bitrate
+			bestLink = value.Get("url").String()
+		}
+		if uint64(a.Quality) == bitrate {
+			link = value.Get("url").String()
+		}
+		return true
+	})
+	if link == "" {
+		link = bestLink
+	}
+	return &Platform{
+		Type:           ACFUN,
+		RoomID:         a.RoomID,
+		Status:         uint(a.Status),
+		CurrentQuality: a.Quality,
+		Link:           link,
+		Qualities:      qualities,
+		Title:          a.play.Get("caption").String(),
+	}, nil
+}
+
+// danmaku data structure
+// +-----------+-------------+--------------+-----------------+-------------------+
+// |   MAGIC   |  HEADERLEN  |  PAYLOADLEN  |     HEADER      |      PAYLOAD      |
+// +-----------+-------------+--------------+-----------------+-------------------+
+// |     4     |      4      |      4       |   HEADERLEN     |    PAYLOADLEN     |
+// +-----------+-------------+--------------+-----------------+-------------------+
+// header is a protobuf PacketHeader, payload is an Upstream/DownstreamPayload encrypted
+// by aes-cbc with a 16 bytes iv prefix, register uses the visitor security key and others
+// use the session key returned by register
+// source: https://github.com/orzogc/acfundanmu/blob/master/proto.go
+// note: data in head are big endian
+func (a *Acfun) encode(command string, seqID int64, data []byte) ([]byte, error) {
+	payload := &pbWriter{}
+	payload.String(1, command)
+	payload.Int(2, seqID)
+	payload.Uint(3, 1)
+	payload.Bytes(4, data)
+	payload.String(9, AcfunSubBiz)
+	header := &pbWriter{}
+	header.Int(1, AcfunAppID)
+	header.Int(2, a.userID)
+	header.Int(3, a.instanceID)
+	header.Uint(7, uint64(len(payload.Data())))
+	header.Int(10, seqID)
+	header.String(12, AcfunKpn)
+	key := a.sessionKey
+	if command == ACFUN_CMD_REGISTER {
+		key = a.securityKey
+		header.Uint(8, ACFUN_ENCRYPTION_SERVICE_TOKEN)
+		header.Message(9, func(w *pbWriter) {
+			w.Uint(1, 1)
+			w.String(2, a.visitorSt)
+		})
+	} else {
+		header.Uint(8, ACFUN_ENCRYPTION_SESSION_KEY)
+	}
+	body, err := acfunEncrypt(key, payload.Data())
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 12)
+	binary.BigEndian.PutUint32(frame[0:], AcfunPacketMagic)
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(header.Data())))
+	binary.BigEndian.PutUint32(frame[8:], uint32(len(body)))
+	return append(append(frame, header.Data()...), body...), nil
+}
+
+// decode returns the command, sequence id and payload data of a downstream frame
+func (a *Acfun) decode(raw []byte) (string, int64, []byte, error) {
+	if len(raw) < 12 || binary.BigEndian.Uint32(raw) != AcfunPacketMagic {
+		return "", 0, nil, errors.New("invalid acfun frame")
+	}
+	headerLength, payloadLength := int(binary.BigEndian.Uint32(raw[4:])), int(binary.BigEndian.Uint32(raw[8:]))
+	if headerLength < 0 || payloadLength < 0 || 12+headerLength+payloadLength > len(raw) {
+		return "", 0, nil, errors.New("invalid acfun frame length")
+	}
+	header, err := pbUnmarshal(raw[12 : 12+headerLength])
+	if err != nil {
+		return "", 0, nil, err
+	}
+	body := raw[12+headerLength : 12+headerLength+payloadLength]
+	switch header.Uint(8) {
+	case ACFUN_ENCRYPTION_SERVICE_TOKEN:
+		body, err = acfunDecrypt(a.securityKey, body)
+	case ACFUN_ENCRYPTION_SESSION_KEY:
+		body, err = acfunDecrypt(a.sessionKey, body)
+	}
+	if err != nil {
+		return "", 0, nil, err
+	}
+	payload, err := pbUnmarshal(body)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return payload.String(1), payload.Int(2), payload.Bytes(4), nil
+}
+
+func acfunEncrypt(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	// pkcs7 padding
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	data = append(data, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	res := make([]byte, aes.BlockSize+len(data))
+	iv := res[:aes.BlockSize]
+	if _, err = rand.Read(iv); err != nil {
+		return nil, err
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(res[aes.BlockSize:], data)
+	return res, nil
+}
+
+func acfunDecrypt(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2*aes.BlockSize || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid acfun encrypted payload")
+	}
+	res := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, data[:aes.BlockSize]).CryptBlocks(res, data[aes.BlockSize:])
+	padding := int(res[len(res)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("invalid acfun payload padding")
+	}
+	return res[:len(res)-padding], nil
+}
+
+// csCmd wraps a live interactive command with the ticket and live id
+func (a *Acfun) csCmd(cmdType string, f func(w *pbWriter)) ([]byte, error) {
+	payload := &pbWriter{}
+	f(payload)
+	cmd := &pbWriter{}
+	cmd.String(1, cmdType)
+	cmd.Bytes(2, payload.Data())
+	cmd.String(3, a.play.Get("availableTickets.0").String())
+	cmd.String(4, a.play.Get("liveId").String())
+	a.seqID++
+	return a.encode(ACFUN_CMD_CS, a.seqID, cmd.Data())
+}
+
+// authenticate registers the link session and enters the room, it must be done
+// before listener starts since the session key is needed by later frames
+func (a *Acfun) authenticate() error {
+	register := &pbWriter{}
+	register.Message(1, func(w *pbWriter) {
+		w.String(4, AcfunSdkVersion)
+		w.String(6, AcfunLinkVersion)
+	})
+	register.Message(2, func(w *pbWriter) {
+		w.Uint(1, 9)
+		w.String(3, "h5")
+		w.String(5, a.did)
+	})
+	register.Uint(4, 1)
+	register.Uint(5, 1)
+	register.Message(10, func(w *pbWriter) {
+		w.String(1, AcfunKpn)
+		w.String(2, AcfunKpf)
+		w.Int(6, a.userID)
+		w.String(7, a.did)
+	})
+	a.seqID++
+	data, err := a.encode(ACFUN_CMD_REGISTER, a.seqID, register.Data())
+	if err != nil {
+		return err
+	}
+	err = a.Dan.WriteMessage(websocket.BinaryMessage, data)
+	if err != nil {
+		return err
+	}
+	_ = a.Dan.SetReadDeadline(time.Now().Add(time.Second * 10))
+	defer a.Dan.SetReadDeadline(time.Time{})
+	for a.sessionKey == nil {
+		_, raw, err := a.Dan.ReadMessage()
+		if err != nil {
+			return err
+		}
+		command, _, payload, err := a.decode(raw)
+		if err != nil {
+			return err
+		}
+		if command != ACFUN_CMD_REGISTER {
+			continue
+		}
+		response, err := pbUnmarshal(payload)
+		if err != nil {
+			return err
+		}
+		a.sessionKey = response.Bytes(1)
+		a.instanceID = response.Int(2)
+	}
+	// enter room to receive danmaku
+	data, err = a.csCmd(ACFUN_CS_ENTER_ROOM, func(w *pbWriter) {
+		w.String(4, a.play.Get("enterRoomAttach").String())
+		w.String(5, AcfunSdkVersion)
+	})
+	if err != nil {
+		return err
+	}
+	return a.Dan.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (a *Acfun) heartBeat(ctx context.Context) error {
+	defer logger.Infof("heartbeat of room %s exited", a.RoomID)
+	ticker := time.NewTicker(AcfunHeartbeatGap)
+	defer ticker.Stop()
+	sequence := int64(0)
+	for {
+		select {
+		case <-ticker.C:
+			sequence++
+			heartbeat, err := a.csCmd(ACFUN_CS_HEARTBEAT, func(w *pbWriter) {
+				w.Int(1, time.Now().UnixNano()/int64(time.Millisecond))
+				w.Int(2, sequence)
+			})
+			if err != nil {
+				return err
+			}
+			keepAlive := &pbWriter{}
+			keepAlive.Uint(1, 1)
+			keepAlive.Uint(2, 1)
+			a.seqID++
+			alive, err := a.encode(ACFUN_CMD_KEEP_ALIVE, a.seqID, keepAlive.Data())
+			if err != nil {
+				return err
+			}
+			for _, data := range [][]byte{heartbeat, alive} {
+				err = a.Dan.WriteMessage(websocket.BinaryMessage, data)
+				if err != nil {
+					return err
+				}
+			}
+		case ack := <-a.ack:
+			err := a.Dan.WriteMessage(websocket.BinaryMessage, ack)
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// acfunComments extracts comments from a pushed ZtLiveScMessage
+func acfunComments(data []byte) ([]pbMessage, error) {
+	message, err := pbUnmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if message.String(1) != ACFUN_SC_SIGNAL {
+		return nil, nil
+	}
+	payload := message.Bytes(3)
+	if message.Int(2) == ACFUN_COMPRESSION_GZIP {
+		payload, err = gunzip(ACFUN, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	signal, err := pbUnmarshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	var res []pbMessage
+	for _, item := range signal.Messages(1) {
+		if item.String(1) != ACFUN_SIGNAL_COMMENT {
+			continue
+		}
+		for _, v := range item[2] {
+			b, _ := v.([]byte)
+			comment, err := pbUnmarshal(b)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, comment)
+		}
+	}
+	return res, nil
+}
+
+// handle acks a push and converts its comments to danmaku, other commands are ignored
+func (a *Acfun) handle(raw []byte) ([]*Danmaku, error) {
+	command, seqID, payload, err := a.decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	if command != ACFUN_CMD_PUSH {
+		return nil, nil
+	}
+	// every push must be acked with its sequence id
+	if ack, err := a.encode(ACFUN_CMD_PUSH, seqID, nil); err == nil {
+		select {
+		case a.ack <- ack:
+		default:
+		}
+	}
+	res, err := acfunComments(payload)
+	if err != nil {
+		return nil, err
+	}
+	var danmakus []*Danmaku
+	for _, comment := range res {
+		// userInfo: 1 userId, 2 nickname
+		user := comment.Message(3)
+		danmakus = append(danmakus, &Danmaku{
+			Kind:      KIND_CHAT,
+			Text:      comment.String(1),
+			Color:     "#ffffff",
+			Type:      DANMAKU_SCROLL,
+			UID:       fmt.Sprint(user.Int(1)),
+			Name:      user.String(2),
+			Timestamp: comment.Int(2),
+		})
+	}
+	return danmakus, nil
+}
+
+func (a *Acfun) dial() error {
+	conn, _, err := websocket.DefaultDialer.Dial(AcfunDanmakuUrl, nil)
+	if err != nil {
+		return err
+	}
+	logger.Infof("connect to danmaku %s", a.RoomID)
+	a.Dan = conn
+	a.ack = make(chan []byte, 16)
+	// a new link session is registered on every connection
+	a.sessionKey = nil
+	err = a.authenticate()
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (a *Acfun) serve(ctx context.Context) error {
+	return serveConn(ctx, a.Dan, a.listen(a.Dan, a.handle), a.heartBeat)
+}
@@ -0,0 +1,191 @@
+package platform
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func testAcfun() *Acfun {
+	return &Acfun{
+		userID:      1000,
+		visitorSt:   "visitor-st",
+		securityKey: []byte("0123456789abcdef"),
+		sessionKey:  []byte("fedcba9876543210"),
+		instanceID:  42,
+	}
+}
+
+func TestAcfunCrypt(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	for _, n := range []int{0, 1, 15, 16, 17, 100} {
+		data := bytes.Repeat([]byte{'x'}, n)
+		encrypted, err := acfunEncrypt(key, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// iv and at least one block of padding
+		if len(encrypted)%16 != 0 || len(encrypted) < 32 {
+			t.Errorf("%d bytes encrypted to %d bytes", n, len(encrypted))
+		}
+		decrypted, err := acfunDecrypt(key, encrypted)
+		if err != nil || !bytes.Equal(decrypted, data) {
+			t.Errorf("%d bytes: got %q %v", n, decrypted, err)
+		}
+	}
+	invalid := map[string][]byte{
+		"empty":     nil,
+		"iv only":   make([]byte, 16),
+		"unaligned": make([]byte, 40),
+	}
+	for name, data := range invalid {
+		if _, err := acfunDecrypt(key, data); err == nil {
+			t.Errorf("%s decrypted without error", name)
+		}
+	}
+	if _, err := acfunEncrypt([]byte("short"), []byte("data")); err == nil {
+		t.Error("encrypted with invalid key")
+	}
+}
+
+func TestAcfunEncodeDecode(t *testing.T) {
+	tests := []struct {
+		command    string
+		encryption uint64
+	}{
+		{ACFUN_CMD_REGISTER, ACFUN_ENCRYPTION_SERVICE_TOKEN},
+		{ACFUN_CMD_KEEP_ALIVE, ACFUN_ENCRYPTION_SESSION_KEY},
+		{ACFUN_CMD_PUSH, ACFUN_ENCRYPTION_SESSION_KEY},
+	}
+	a := testAcfun()
+	for i, tt := range tests {
+		seqID := int64(i + 1)
+		frame, err := a.encode(tt.command, seqID, []byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if binary.BigEndian.Uint32(frame) != AcfunPacketMagic {
+			t.Fatalf("%s: magic %x", tt.command, frame[:4])
+		}
+		header, err := pbUnmarshal(frame[12 : 12+binary.BigEndian.Uint32(frame[4:])])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Int(1) != AcfunAppID || header.Int(2) != 1000 || header.Int(3) != 42 ||
+			header.Uint(8) != tt.encryption || header.Int(10) != seqID {
+			t.Errorf("%s: got header %v", tt.command, header)
+		}
+		if tt.command == ACFUN_CMD_REGISTER && header.Message(9).String(2) != "visitor-st" {
+			t.Errorf("%s: token info %v", tt.command, header.Message(9))
+		}
+		command, gotSeqID, payload, err := a.decode(frame)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.command, err)
+		}
+		if command != tt.command || gotSeqID != seqID || string(payload) != "payload" {
+			t.Errorf("%s: got %s %d %q", tt.command, command, gotSeqID, payload)
+		}
+	}
+}
+
+func TestAcfunDecodeInvalid(t *testing.T) {
+	a := testAcfun()
+	frame, err := a.encode(ACFUN_CMD_PUSH, 1, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	badMagic := append([]byte{}, frame...)
+	badMagic[0] = 0
+	long := append([]byte{}, frame...)
+	binary.BigEndian.PutUint32(long[8:], uint32(len(frame)))
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"short", frame[:8]},
+		{"bad magic", badMagic},
+		{"truncated", frame[:len(frame)-1]},
+		{"payload length", long},
+	}
+	for _, tt := range tests {
+		if _, _, _, err := a.decode(tt.frame); err == nil {
+			t.Errorf("%s: decoded without error", tt.name)
+		}
+	}
+}
+
+// acfunSignal makes a ZtLiveScMessage of action signals, every item is a signal type
+// with its payloads
+func acfunSignal(messageType string, compression int64, items map[string][][]byte) []byte {
+	signal := &pbWriter{}
+	for signalType, payloads := range items {
+		signalType, payloads := signalType, payloads
+		signal.Message(1, func(w *pbWriter) {
+			w.String(1, signalType)
+			for _, payload := range payloads {
+				w.Bytes(2, payload)
+			}
+		})
+	}
+	payload := signal.Data()
+	if compression == ACFUN_COMPRESSION_GZIP {
+		payload = gzipBody(payload)
+	}
+	w := &pbWriter{}
+	w.String(1, messageType)
+	w.Int(2, compression)
+	w.Bytes(3, payload)
+	return w.Data()
+}
+
+func acfunComment(text string, uid int64, name string) []byte {
+	w := &pbWriter{}
+	w.String(1, text)
+	w.Int(2, 1700000000000)
+	w.Message(3, func(w *pbWriter) {
+		w.Int(1, uid)
+		w.String(2, name)
+	})
+	return w.Data()
+}
+
+func TestAcfunComments(t *testing.T) {
+	comments := map[string][][]byte{
+		ACFUN_SIGNAL_COMMENT:     {acfunComment("hello", 1, "a"), acfunComment("world", 2, "b")},
+		"CommonActionSignalLike": {[]byte{}},
+	}
+	broken := &pbWriter{}
+	broken.String(1, ACFUN_SC_SIGNAL)
+	broken.Int(2, ACFUN_COMPRESSION_GZIP)
+	broken.Bytes(3, []byte("not gzip"))
+	tests := []struct {
+		name  string
+		data  []byte
+		texts []string
+		err   bool
+	}{
+		{name: "plain", data: acfunSignal(ACFUN_SC_SIGNAL, 1, comments), texts: []string{"hello", "world"}},
+		{name: "gzip", data: acfunSignal(ACFUN_SC_SIGNAL, ACFUN_COMPRESSION_GZIP, comments), texts: []string{"hello", "world"}},
+		{name: "other message", data: acfunSignal("ZtLiveScStatusChanged", 1, comments)},
+		{name: "broken gzip", data: broken.Data(), err: true},
+		{name: "broken comment", data: acfunSignal(ACFUN_SC_SIGNAL, 1, map[string][][]byte{ACFUN_SIGNAL_COMMENT: {{0xff}}}), err: true},
+	}
+	for _, tt := range tests {
+		res, err := acfunComments(tt.data)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		var texts []string
+		for _, comment := range res {
+			texts = append(texts, comment.String(1))
+			if comment.Int(2) != 1700000000000 || comment.Message(3).String(2) == "" {
+				t.Errorf("%s: got comment %v", tt.name, comment)
+			}
+		}
+		if !reflect.DeepEqual(texts, tt.texts) {
+			t.Errorf("%s: got %q, want %q", tt.name, texts, tt.texts)
+		}
+	}
+}
@@ -1,26 +1,136 @@
 package platform
 
 import (
-	"errors"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"io"
+	"io/ioutil"
 	"live/util"
+	"net/url"
+	"regexp"
+	"sync"
 	"time"
 )
 
-type Type uint32
+var logger = util.GetLogger()
 
+// display mode of danmaku
 const (
-	BILIBILI Type = iota
-	DOUYU
+	DANMAKU_SCROLL = 0
+	DANMAKU_TOP    = 1
+	DANMAKU_BOTTOM = 2
 )
 
-var logger = util.GetLogger()
+// kind of danmaku, tells chat apart from other events
+const (
+	KIND_CHAT       = "chat"
+	KIND_GIFT       = "gift"
+	KIND_SUPER_CHAT = "superchat"
+	KIND_GUARD      = "guard"
+	KIND_ENTRY      = "entry"
+	KIND_LIKE       = "like"
+	KIND_STATUS     = "status"
+	KIND_STATS      = "stats"
+)
+
+// event of status danmaku
+const (
+	STATUS_LIVE    = "live"
+	STATUS_OFFLINE = "offline"
+	// room info like title changed
+	STATUS_UPDATE = "update"
+	// danmaku connection of room is broken and being redialed, clients keep connected
+	STATUS_RECONNECTING = "reconnecting"
+	STATUS_RECONNECTED  = "reconnected"
+)
 
 type Danmaku struct {
+	Kind  string `json:"kind"`
 	Text  string `json:"text"`
 	Color string `json:"color"`
 	Type  int    `json:"type"`
+	// sender, uid is a string since some platforms use string ids
+	UID  string `json:"uid,omitempty"`
+	Name string `json:"name,omitempty"`
+	// unix time in milliseconds
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Level     int    `json:"level,omitempty"`
+	Medal     *Medal `json:"medal,omitempty"`
+	Admin     bool   `json:"admin,omitempty"`
+	// guard level of bilibili, 1 is the highest, 0 means no guard
+	Guard int `json:"guard,omitempty"`
+	// gift of gift, super chat and guard events
+	Gift *Gift `json:"gift,omitempty"`
+	// live status of status events, clients may reload live info on it
+	Status *LiveStatus `json:"status,omitempty"`
+	// latest stats of room in stats events
+	Stats *Stats `json:"stats,omitempty"`
+	// original message from platform, only sent to clients asking for it
+	Raw json.RawMessage `json:"raw,omitempty"`
+}
+
+// fan medal of streamer
+type Medal struct {
+	Name  string `json:"name"`
+	Level int    `json:"level"`
+}
+
+// gift sent by sender, super chat and guard are paid gifts too
+type Gift struct {
+	ID    string `json:"id,omitempty"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	// total price in cny cents, 0 for free or unknown gifts
+	Price int64 `json:"price"`
+	// seconds of super chat staying on top
+	Duration int `json:"duration,omitempty"`
+}
+
+// live status change of room
+type LiveStatus struct {
+	Event string `json:"event"`
+	Title string `json:"title,omitempty"`
+	Area  string `json:"area,omitempty"`
+}
+
+// popularity and online count of room, fields not sent by platform are 0
+type Stats struct {
+	// popularity of bilibili heartbeat reply
+	Popularity int64 `json:"popularity,omitempty"`
+	// users watched the live
+	Watched int64 `json:"watched,omitempty"`
+	// online users
+	Online int64 `json:"online,omitempty"`
+	// online nobles of douyu
+	Nobles int64 `json:"nobles,omitempty"`
+}
+
+// roomStats is the latest stats of a danmaku room, it's updated by listener and read by live info
+type roomStats struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+// Update changes stats by update
+func (s *roomStats) Update(update func(stats *Stats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(&s.stats)
+}
+
+// Get returns a copy of stats, nil before any stats received
+func (s *roomStats) Get() *Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stats == (Stats{}) {
+		return nil
+	}
+	stats := s.stats
+	return &stats
 }
 
 type Quality struct {
@@ -29,40 +139,220 @@ type Quality struct {
 }
 
 type Platform struct {
-	Type           Type      `json:"type"`
-	RoomID         uint      `json:"room_id"`
-	Status         uint      `json:"status"`
-	CurrentQuality uint      `json:"current_quality"`
-	Link           string    `json:"link"`
-	Qualities      []Quality `json:"qualities"`
+	Type           Type   `json:"type"`
+	RoomID         string `json:"room_id"`
+	Status         uint   `json:"status"`
+	CurrentQuality uint   `json:"current_quality"`
+	Link           string `json:"link"`
+	// every line of the stream, link is one of them
+	Links []Link `json:"links,omitempty"`
+	// streams of every protocol, format and codec, links are lines of the chosen one. only
+	// platforms with streams capability have them
+	Streams   []Stream  `json:"streams,omitempty"`
+	Qualities []Quality `json:"qualities"`
+	Title     string    `json:"title,omitempty"`
+	Cover     string    `json:"cover,omitempty"`
+	Streamer  *Streamer `json:"streamer,omitempty"`
+	// area or category of live
+	Area string `json:"area,omitempty"`
+	// unix time in seconds live started, 0 if offline or unknown
+	StartTime int64 `json:"start_time,omitempty"`
+	// online or popularity count shown by platform
+	Online int64    `json:"online,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+	// stats of danmaku room, only exists when someone is receiving danmaku
+	Stats *Stats `json:"stats,omitempty"`
+}
+
+// protocol, format and codec of streams
+const (
+	PROTOCOL_HTTP_STREAM = "http_stream"
+	PROTOCOL_HTTP_HLS    = "http_hls"
+	FORMAT_FLV           = "flv"
+	FORMAT_TS            = "ts"
+	FORMAT_FMP4          = "fmp4"
+	CODEC_AVC            = "avc"
+	CODEC_HEVC           = "hevc"
+)
+
+// stream of a protocol, format and codec
+type Stream struct {
+	Protocol string `json:"protocol"`
+	Format   string `json:"format"`
+	Codec    string `json:"codec"`
+	Quality  uint   `json:"quality"`
+	Links    []Link `json:"links"`
+}
+
+// StreamPreference is the stream asked by client, empty fields match any stream
+type StreamPreference struct {
+	Protocol string
+	Format   string
+	Codec    string
+}
+
+// Choose returns index of the stream matching preference best, protocol matters more than
+// format and format more than codec. the first one wins a tie
+func (p StreamPreference) Choose(streams []Stream) int {
+	best, bestScore := 0, -1
+	for i, stream := range streams {
+		score := 0
+		if p.Protocol == "" || p.Protocol == stream.Protocol {
+			score += 4
+		}
+		if p.Format == "" || p.Format == stream.Format {
+			score += 2
+		}
+		if p.Codec == "" || p.Codec == stream.Codec {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// streamRoom is a room whose stream can be chosen
+type streamRoom interface {
+	SetPreference(preference StreamPreference)
+}
+
+// line of a stream served by a cdn
+type Link struct {
+	URL  string `json:"url"`
+	Host string `json:"host"`
+	// cdn name given by platform
+	CDN string `json:"cdn,omitempty"`
+	// probe result in milliseconds, empty unless probed
+	Connect   int64  `json:"connect,omitempty"`
+	FirstByte int64  `json:"first_byte,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// newLink labels url with its host
+func newLink(link, cdn string) Link {
+	host := ""
+	if u, err := url.Parse(link); err == nil {
+		host = u.Hostname()
+	}
+	return Link{URL: link, Host: host, CDN: cdn}
+}
+
+// streamer of room
+type Streamer struct {
+	UID    string `json:"uid"`
+	Name   string `json:"name"`
+	Avatar string `json:"avatar,omitempty"`
 }
 
 type Room interface {
 	GetLiveInfo() (*Platform, error)
-	GetClients() map[*websocket.Conn]bool
+	// clients of danmaku
+	GetClients() *Clients
 	IsClosed() bool
 	Send(danmaku *Danmaku)
 	Close()
 	Connect()
 }
 
-// danmaku cache
-var rooms = map[string]Room{}
+// statsRoom is a room keeping the latest stats from danmaku
+type statsRoom interface {
+	GetStats() *Stats
+}
 
-func selectPlatform(platform Type, roomID, quality uint, client *websocket.Conn) (Room, error) {
-	switch platform {
-	case BILIBILI:
-		return GetBilibiliRoom(roomID, quality, client)
-	case DOUYU:
-		return GetDouyuRoom(roomID, quality, client)
-	default:
-		return nil, errors.New(fmt.Sprintf("platform %d not found", platform))
+func selectPlatform(platform Type, roomID string, quality uint, client *websocket.Conn) (Room, error) {
+	adapter, err := Lookup(platform)
+	if err != nil {
+		return nil, err
+	}
+	return adapter.New(roomID, quality, client)
+}
+
+// pageJSON extracts the json object embedded in a page script, re should match
+// the text before the object and end with its opening brace. the result is empty if not found
+func pageJSON(html []byte, re *regexp.Regexp) (gjson.Result, error) {
+	loc := re.FindIndex(html)
+	if loc == nil {
+		return gjson.Result{}, nil
+	}
+	var raw json.RawMessage
+	// decoder stops at the end of the object and ignores the rest of the page
+	err := json.NewDecoder(bytes.NewReader(html[loc[1]-1:])).Decode(&raw)
+	if err != nil {
+		return gjson.Result{}, err
 	}
+	return gjson.ParseBytes(raw), nil
+}
+
+// FrameError is returned by danmaku frame readers on malformed frames, the
+// stream can't be read any more after it
+type FrameError struct {
+	Platform Type
+	Reason   string
 }
 
-func AddClient(room Room, conn *websocket.Conn) {
-	clients := room.GetClients()
-	clients[conn] = true
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("invalid danmaku frame of platform %d: %s", e.Platform, e.Reason)
+}
+
+// decompressed frames larger than it are treated as malformed
+const MAX_DECOMPRESSED_LENGTH = 1 << 24
+
+// gunzip decompresses a gzip frame of platform, the output is limited to MAX_DECOMPRESSED_LENGTH
+func gunzip(platform Type, data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, &FrameError{platform, err.Error()}
+	}
+	res, err := ioutil.ReadAll(io.LimitReader(r, MAX_DECOMPRESSED_LENGTH+1))
+	if err != nil {
+		return nil, &FrameError{platform, err.Error()}
+	}
+	if len(res) > MAX_DECOMPRESSED_LENGTH {
+		return nil, &FrameError{platform, "decompressed frame too large"}
+	}
+	return res, nil
+}
+
+// nowMillis is the timestamp of danmaku from platforms not sending it
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// danmakuFor returns danmaku sent to client, raw message is dropped unless the client wants it
+func danmakuFor(raw bool, danmaku *Danmaku) *Danmaku {
+	if !raw && danmaku.Raw != nil {
+		_danmaku := *danmaku
+		_danmaku.Raw = nil
+		danmaku = &_danmaku
+	}
+	return danmaku
+}
+
+func closeConn(conn *websocket.Conn) {
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "close")
+	_ = conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second*5))
+	_ = conn.Close()
+}
+
+// joinRoom adds client to the room of index, a new room made by create is used
+// if there is no room or the room is closed before client is added, so create may
+// be called more than once and must make a new room every time
+func joinRoom(index string, create func() Room, client *websocket.Conn) Room {
+	for {
+		room := hub.Load(index, create)
+		if AddClient(room, client) {
+			return room
+		}
+	}
+}
+
+// AddClient returns false if room is closed
+func AddClient(room Room, conn *websocket.Conn) bool {
+	if !room.GetClients().Add(conn) {
+		return false
+	}
 	logger.Infof("add client %+v", conn.RemoteAddr())
 	// listen close event
 	go func() {
@@ -83,37 +373,67 @@ func AddClient(room Room, conn *websocket.Conn) {
 			_, _, err := conn.ReadMessage()
 			if err != nil {
 				RemoveClient(room, conn)
+				break
 			}
 		}
 	}()
+	return true
 }
 
 func RemoveClient(room Room, conn *websocket.Conn) {
-	clients := room.GetClients()
 	_ = conn.Close()
-	if _, ok := clients[conn]; ok {
-		delete(clients, conn)
-	}
 	// all clients exited
-	if len(clients) == 0 {
+	if room.GetClients().Remove(conn) == 0 {
 		room.Close()
 	}
 }
 
-func InitRoom(platform Type, roomID, quality uint) (*Platform, error) {
+// InitRoom returns live info of the preferred stream, links are ranked by latency if probe is true
+func InitRoom(platform Type, roomID string, quality uint, probe bool, preference StreamPreference) (*Platform, error) {
 	room, err := selectPlatform(platform, roomID, quality, nil)
 	if err != nil {
 		return nil, err
 	}
-	return room.GetLiveInfo()
+	if room, ok := room.(streamRoom); ok {
+		room.SetPreference(preference)
+	}
+	info, err := room.GetLiveInfo()
+	if err != nil {
+		return nil, err
+	}
+	// platforms with a single line only set link
+	if len(info.Links) == 0 && info.Link != "" {
+		info.Links = []Link{newLink(info.Link, "")}
+	}
+	if probe && len(info.Links) > 0 {
+		ProbeLinks(info.Links)
+		if info.Links[0].Error == "" {
+			info.Link = info.Links[0].URL
+		}
+	}
+	// stats are kept by the danmaku room
+	if room, ok := hub.Get(roomIndex(platform, info.RoomID)).(statsRoom); ok {
+		info.Stats = room.GetStats()
+	}
+	return info, nil
 }
 
-func InitDanmaku(platform Type, roomID uint, conn *websocket.Conn) {
+// Metrics returns client metrics of danmaku rooms
+func Metrics() []RoomMetrics {
+	return hub.Metrics()
+}
+
+// InitDanmaku adds client to the danmaku room, policy of the client is the default one if it's empty
+func InitDanmaku(platform Type, roomID string, conn *websocket.Conn, raw bool, policy QueuePolicy) {
 	room, err := selectPlatform(platform, roomID, 0, conn)
 	if err != nil {
 		logger.Error(err)
 		_ = conn.Close()
 		return
 	}
-	room.Connect()
+	room.GetClients().SetRaw(conn, raw)
+	if policy != "" {
+		room.GetClients().SetPolicy(conn, policy)
+	}
+	hub.Connect(room)
 }
@@ -0,0 +1,75 @@
+package platform
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+)
+
+// fixture reads a recorded page or frame in testdata
+func fixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func gzipBody(data []byte) []byte {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	_, _ = w.Write(data)
+	_ = w.Close()
+	return b.Bytes()
+}
+
+func TestGunzip(t *testing.T) {
+	data, err := gunzip(DOUYIN, gzipBody([]byte("frame")))
+	if err != nil || string(data) != "frame" {
+		t.Fatalf("got %q %v", data, err)
+	}
+	// a small bomb expanding beyond the limit
+	_, err = gunzip(DOUYIN, gzipBody(make([]byte, MAX_DECOMPRESSED_LENGTH+1)))
+	if _, ok := err.(*FrameError); !ok {
+		t.Fatalf("got %v, want a frame error", err)
+	}
+	_, err = gunzip(DOUYIN, []byte("not gzip"))
+	if _, ok := err.(*FrameError); !ok {
+		t.Fatalf("got %v, want a frame error", err)
+	}
+}
+
+func TestStreamPreferenceChoose(t *testing.T) {
+	streams := []Stream{
+		{Protocol: PROTOCOL_HTTP_STREAM, Format: FORMAT_FLV, Codec: CODEC_AVC},
+		{Protocol: PROTOCOL_HTTP_HLS, Format: FORMAT_TS, Codec: CODEC_AVC},
+		{Protocol: PROTOCOL_HTTP_HLS, Format: FORMAT_FMP4, Codec: CODEC_AVC},
+		{Protocol: PROTOCOL_HTTP_HLS, Format: FORMAT_FMP4, Codec: CODEC_HEVC},
+	}
+	tests := []struct {
+		name       string
+		preference StreamPreference
+		want       int
+	}{
+		{name: "any", want: 0},
+		{name: "protocol", preference: StreamPreference{Protocol: PROTOCOL_HTTP_HLS}, want: 1},
+		{name: "format", preference: StreamPreference{Format: FORMAT_FMP4}, want: 2},
+		{name: "codec", preference: StreamPreference{Codec: CODEC_HEVC}, want: 3},
+		{name: "all", preference: StreamPreference{Protocol: PROTOCOL_HTTP_HLS, Format: FORMAT_FMP4, Codec: CODEC_HEVC}, want: 3},
+		// protocol matters more than format and format more than codec
+		{name: "protocol over format", preference: StreamPreference{Protocol: PROTOCOL_HTTP_STREAM, Format: FORMAT_FMP4}, want: 0},
+		{name: "format over codec", preference: StreamPreference{Format: FORMAT_TS, Codec: CODEC_HEVC}, want: 1},
+		// nothing matches, the first stream is the fallback
+		{name: "no match", preference: StreamPreference{Protocol: "rtmp", Format: "mp4", Codec: "av1"}, want: 0},
+		{name: "codec only", preference: StreamPreference{Protocol: "rtmp", Format: "mp4", Codec: CODEC_HEVC}, want: 3},
+	}
+	for _, tt := range tests {
+		if got := tt.preference.Choose(streams); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if got := (StreamPreference{Codec: CODEC_HEVC}).Choose(nil); got != 0 {
+		t.Errorf("no streams: got %d", got)
+	}
+}
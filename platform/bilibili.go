@@ -8,18 +8,43 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/andybalholm/brotli"
 	"github.com/gorilla/websocket"
 	"github.com/tidwall/gjson"
+	"io"
 	"io/ioutil"
 	"live/util"
 	"math/rand"
+	"regexp"
+	"strings"
 	"time"
 )
 
 const (
-	BilibiliInitUrl    = "https://api.live.bilibili.com/xlive/web-room/v1/index/getInfoByRoom?room_id=%d"
-	BilibiliLinkUrl    = "https://api.live.bilibili.com/xlive/web-room/v1/index/getRoomPlayInfo?room_id=%d&play_url=1&mask=1&qn=%d&platform=web"
+	BilibiliInitUrl = "https://api.live.bilibili.com/xlive/web-room/v1/index/getInfoByRoom?room_id=%s"
+	BilibiliLinkUrl = "https://api.live.bilibili.com/xlive/web-room/v2/index/getRoomPlayInfo?room_id=%d&protocol=0,1&format=0,1,2&codec=0,1&qn=%d&platform=web&ptype=8"
+	// cmd of heartbeat reply decoded as message
+	BilibiliHeartbeatReplyCmd = "HEARTBEAT_REPLY"
+)
+
+// danmaku servers are vars so that tests can replace them with a local one
+var (
 	BilibiliDanmakuUrl = "wss://broadcastlv.chat.bilibili.com/sub"
+	BilibiliServerUrl  = "https://api.live.bilibili.com/xlive/web-room/v1/index/getDanmuInfo?id=%d&type=0"
+	BilibiliHostUrl    = "wss://%s:%d/sub"
+)
+
+const (
+	WS_BODY_PROTOCOL_VERSION_NORMAL  = 0
+	WS_BODY_PROTOCOL_VERSION_INT     = 1
+	WS_BODY_PROTOCOL_VERSION_DEFLATE = 2
+	WS_BODY_PROTOCOL_VERSION_BROTLI  = 3
+)
+
+const (
+	WS_PACKAGE_HEADER_TOTAL_LENGTH = 16
+	// packages and decompressed bodies larger than it are treated as malformed
+	WS_PACKAGE_MAX_LENGTH = 1 << 24
 )
 
 const (
@@ -30,53 +55,67 @@ const (
 	WS_OP_CONNECT_SUCCESS     = 8
 )
 
+const BILIBILI Type = 0
+
+var BilibiliRoomUrlRe = regexp.MustCompile(`^(?:live|m)\.bilibili\.com/(?:h5/|blanc/)?(\d+)`)
+
+func init() {
+	Register(&Adapter{
+		Type:         BILIBILI,
+		Name:         "bilibili",
+		Capabilities: Capabilities{Danmaku: true, Reconnect: true, Stats: true, Raw: true, Streams: true},
+		URL:          BilibiliRoomUrlRe,
+		ShortHosts:   []string{"b23.tv"},
+		New:          GetBilibiliRoom,
+	})
+}
+
 type Bilibili struct {
-	ctx     context.Context
-	cancel  context.CancelFunc
-	Closed  bool
-	Clients map[*websocket.Conn]bool
+	*BaseRoom
 	Dan     *websocket.Conn
 	RoomID  uint
 	Quality uint
+	// preferred stream, the first stream of playurl is used if nothing matches
+	preference StreamPreference
+	// data of getInfoByRoom, only kept for live info
+	room gjson.Result
+	// danmaku token used in authentication
+	token string
+	// packages split over messages, a new one is made for every connection
+	reader *bilibiliReader
 }
 
-func (b *Bilibili) IsClosed() bool {
-	return b.Closed
-}
-
-func (b *Bilibili) GetClients() map[*websocket.Conn]bool {
-	return b.Clients
-}
-
-func GetBilibiliRoom(roomID, quality uint, client *websocket.Conn) (Room, error) {
+func GetBilibiliRoom(id string, quality uint, client *websocket.Conn) (Room, error) {
 	// get real room id
-	res, err := util.Request("GET", fmt.Sprintf(BilibiliInitUrl, roomID), "", nil)
+	res, err := util.Request("GET", fmt.Sprintf(BilibiliInitUrl, id), "", nil)
 	if err != nil {
 		return nil, err
 	}
 	data := gjson.ParseBytes(res)
 	if data.Get("code").Uint() != 0 {
-		return nil, errors.New(fmt.Sprintf("room %d not found", roomID))
+		return nil, errors.New(fmt.Sprintf("room %s not found", id))
 	}
-	roomID = uint(data.Get("data.room_info.room_id").Uint())
+	roomID := uint(data.Get("data.room_info.room_id").Uint())
 	// room info request
 	if client == nil {
 		return &Bilibili{
 			RoomID:  roomID,
 			Quality: quality,
+			room:    data.Get("data"),
 		}, nil
 	}
 	// danmaku request
-	index := fmt.Sprintf("%d:%d", BILIBILI, roomID)
-	if rooms[index] == nil {
-		rooms[index] = &Bilibili{
-			Closed:  false,
-			Clients: make(map[*websocket.Conn]bool),
-			RoomID:  roomID,
+	return joinRoom(roomIndex(BILIBILI, fmt.Sprint(roomID)), func() Room {
+		room := &Bilibili{
+			RoomID: roomID,
 		}
-	}
-	AddClient(rooms[index], client)
-	return rooms[index], nil
+		room.BaseRoom = newBaseRoom(BILIBILI, fmt.Sprint(roomID), room)
+		return room
+	}, client), nil
+}
+
+func (b *Bilibili) SetPreference(preference StreamPreference) {
+	b.preference = preference
 }
 
 func (b *Bilibili) GetLiveInfo() (*Platform, error) {
@@ -88,64 +127,97 @@ func (b *Bilibili) GetLiveInfo() (*Platform, error) {
 		return nil, err
 	}
 	data := gjson.ParseBytes(res)
-	// links
-	//var links []string
-	//data.Get("data.play_url.durl").ForEach(func(key, value gjson.Result) bool {
-	//	links = append(links, value.Get("url").String())
-	//	return true
-	//})
-	rand.Seed(time.Now().UnixNano())
-	links := data.Get("data.play_url.durl").Array()
-	link := links[rand.Int()%len(links)].Get("url").String()
+	playurl := data.Get("data.playurl_info.playurl")
 	// qualities
 	var qualities []Quality
-	data.Get("data.play_url.quality_description").ForEach(func(key, value gjson.Result) bool {
+	playurl.Get("g_qn_desc").ForEach(func(key, value gjson.Result) bool {
 		qualities = append(qualities, Quality{
 			Quality:     value.Get("qn").Uint(),
 			Description: value.Get("desc").String(),
 		})
 		return true
 	})
-	return &Platform{
-		Type:           BILIBILI,
-		RoomID:         b.RoomID,
-		Status:         uint(data.Get("data.live_status").Uint()),
-		CurrentQuality: uint(data.Get("data.play_url.current_qn").Uint()),
-		Link:           link,
-		Qualities:      qualities,
-	}, nil
-}
-
-func (b *Bilibili) Send(danmaku *Danmaku) {
-	logger.Infof("danmaku %+v", danmaku)
-	if len(b.Clients) == 0 {
-		b.Close()
-		return
+	info := b.roomInfo()
+	info.Status = uint(data.Get("data.live_status").Uint())
+	info.Qualities = qualities
+	info.Streams = bilibiliStreams(playurl)
+	if len(info.Streams) == 0 {
+		return info, nil
 	}
-	for client := range b.Clients {
-		err := client.WriteJSON(danmaku)
-		if err != nil {
-			RemoveClient(b, client)
-			continue
-		}
+	stream := info.Streams[b.preference.Choose(info.Streams)]
+	info.CurrentQuality = stream.Quality
+	info.Links = stream.Links
+	// a random line is the default to spread clients over cdns
+	if len(stream.Links) > 0 {
+		info.Link = stream.Links[rand.Intn(len(stream.Links))].URL
 	}
+	return info, nil
 }
 
-func (b *Bilibili) Close() {
-	if b.Closed {
-		return
-	}
-	b.Closed = true
-	// stop heartbeat and listener, note listener will not exit until this func is done
-	b.cancel()
-	// close danmaku websocket (bilibili)
-	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "close")
-	_ = b.Dan.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second*5))
-	for client := range b.Clients {
-		_ = client.Close()
-	}
-	delete(rooms, fmt.Sprintf("%d:%d", BILIBILI, b.RoomID))
-	logger.Infof("room %d closed, rooms %+v", b.RoomID, rooms)
+// bilibiliStreams returns streams of every protocol, format and codec in playurl, every url_info
+// of a codec is a line of a cdn
+func bilibiliStreams(playurl gjson.Result) []Stream {
+	var streams []Stream
+	playurl.Get("stream").ForEach(func(key, protocol gjson.Result) bool {
+		protocol.Get("format").ForEach(func(key, format gjson.Result) bool {
+			format.Get("codec").ForEach(func(key, codec gjson.Result) bool {
+				stream := Stream{
+					Protocol: protocol.Get("protocol_name").String(),
+					Format:   format.Get("format_name").String(),
+					Codec:    codec.Get("codec_name").String(),
+					Quality:  uint(codec.Get("current_qn").Uint()),
+				}
+				base := codec.Get("base_url").String()
+				codec.Get("url_info").ForEach(func(key, value gjson.Result) bool {
+					link := newLink(value.Get("host").String()+base+value.Get("extra").String(), "")
+					// playurl has no cdn name, the node is the first label of host
+					// like cn-gddg-ct-01-01.bilivideo.com
+					link.CDN = strings.SplitN(link.Host, ".", 2)[0]
+					stream.Links = append(stream.Links, link)
+					return true
+				})
+				// codecs without lines can't be played
+				if len(stream.Links) > 0 {
+					streams = append(streams, stream)
+				}
+				return true
+			})
+			return true
+		})
+		return true
+	})
+	return streams
+}
+
+// roomInfo returns live info with room metadata of getInfoByRoom
+func (b *Bilibili) roomInfo() *Platform {
+	room := b.room.Get("room_info")
+	anchor := b.room.Get("anchor_info.base_info")
+	var tags []string
+	for _, tag := range strings.Split(room.Get("tags").String(), ",") {
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	area := room.Get("area_name").String()
+	if parent := room.Get("parent_area_name").String(); parent != "" && area != "" {
+		area = parent + "·" + area
+	}
+	return &Platform{
+		Type:   BILIBILI,
+		RoomID: fmt.Sprint(b.RoomID),
+		Title:  room.Get("title").String(),
+		Cover:  room.Get("cover").String(),
+		Streamer: &Streamer{
+			UID:    room.Get("uid").String(),
+			Name:   anchor.Get("uname").String(),
+			Avatar: anchor.Get("face").String(),
+		},
+		Area:      area,
+		StartTime: room.Get("live_start_time").Int(),
+		Online:    room.Get("online").Int(),
+		Tags:      tags,
+	}
 }
 
 // danmaku data structure
@@ -157,6 +229,8 @@ func (b *Bilibili) Close() {
 // |      4      |   2   |   2   |     4      |     4      |    HEADLEN - 16  |
 // +-------------+-------+-------+------------+------------+------------------+
 // source: https://github.com/metowolf/BilibiliHelper/wiki/%E5%BC%B9%E5%B9%95%E5%8D%8F%E8%AE%AE
+// VER of message body: 0 raw json, 1 int (popularity), 2 zlib, 3 brotli,
+// compressed bodies contain multi packages which are raw json
 // note: data in head are big endian
 func (b *Bilibili) encode(data []byte, op int) []byte {
 	header := []byte{0, 0, 0, 0, 0, 0x10, 0, 0x1, 0, 0, 0, byte(op), 0, 0, 0, 0x1}
@@ -165,46 +239,129 @@ func (b *Bilibili) encode(data []byte, op int) []byte {
 	return append(header, data...)
 }
 
-func (b *Bilibili) decode(raw []byte) ([]string, error) {
-	header := raw[:16]
+// bilibiliPackage is a package read by bilibiliReader
+type bilibiliPackage struct {
+	Version   uint16
+	Operation uint32
+	Body      []byte
+}
+
+// bilibiliReader buffers websocket messages until packages in them are complete
+type bilibiliReader struct {
+	buf []byte
+}
+
+func (r *bilibiliReader) Write(data []byte) {
+	r.buf = append(r.buf, data...)
+}
+
+// Len returns the length of incomplete data
+func (r *bilibiliReader) Len() int {
+	return len(r.buf)
+}
+
+// Next returns the next package, it returns nil without error if more data are needed
+func (r *bilibiliReader) Next() (*bilibiliPackage, error) {
+	if len(r.buf) < WS_PACKAGE_HEADER_TOTAL_LENGTH {
+		return nil, nil
+	}
+	length := binary.BigEndian.Uint32(r.buf[0:])
+	headerLength := binary.BigEndian.Uint16(r.buf[4:])
+	if headerLength < WS_PACKAGE_HEADER_TOTAL_LENGTH || length < uint32(headerLength) {
+		return nil, &FrameError{BILIBILI, fmt.Sprintf("invalid header length %d of package length %d", headerLength, length)}
+	}
+	if length > WS_PACKAGE_MAX_LENGTH {
+		return nil, &FrameError{BILIBILI, fmt.Sprintf("package length %d too large", length)}
+	}
+	if uint32(len(r.buf)) < length {
+		return nil, nil
+	}
+	p := &bilibiliPackage{
+		Version:   binary.BigEndian.Uint16(r.buf[6:]),
+		Operation: binary.BigEndian.Uint32(r.buf[8:]),
+		Body:      r.buf[headerLength:length],
+	}
+	r.buf = r.buf[length:]
+	if len(r.buf) == 0 {
+		r.buf = nil
+	}
+	return p, nil
+}
+
+// decode reads all complete packages of r
+func (b *Bilibili) decode(r *bilibiliReader) ([]string, error) {
 	var res []string
-	operation := binary.BigEndian.Uint32(header[8:])
-	switch operation {
-	case WS_OP_HEARTBEAT_REPLY:
-		logger.Infof("popularity %d", binary.BigEndian.Uint32(raw[16:]))
-	case WS_OP_MESSAGE:
-		buffer := bytes.NewReader(raw[16:])
-		r, err := zlib.NewReader(buffer)
+	for {
+		p, err := r.Next()
 		if err != nil {
-			if errors.Is(err, zlib.ErrHeader) {
-				break
-			}
 			return nil, err
 		}
-		data, err := ioutil.ReadAll(r)
-		if err != nil {
-			return nil, err
+		if p == nil {
+			return res, nil
 		}
-		for offset, length := 0, 0; offset < len(data); offset += length {
-			length = int(binary.BigEndian.Uint32(data[offset:]))
-			res = append(res, string(data[offset+16:offset+length]))
+		body := p.Body
+		switch p.Operation {
+		case WS_OP_HEARTBEAT_REPLY:
+			if len(body) < 4 {
+				return nil, &FrameError{BILIBILI, fmt.Sprintf("invalid heartbeat reply length %d", len(body))}
+			}
+			// popularity is passed to listener like a message
+			res = append(res, fmt.Sprintf(`{"cmd":"%s","popularity":%d}`,
+				BilibiliHeartbeatReplyCmd, binary.BigEndian.Uint32(body)))
+		case WS_OP_MESSAGE:
+			version := p.Version
+			switch version {
+			case WS_BODY_PROTOCOL_VERSION_NORMAL, WS_BODY_PROTOCOL_VERSION_INT:
+				res = append(res, string(body))
+			case WS_BODY_PROTOCOL_VERSION_DEFLATE, WS_BODY_PROTOCOL_VERSION_BROTLI:
+				var r io.Reader
+				if version == WS_BODY_PROTOCOL_VERSION_BROTLI {
+					r = brotli.NewReader(bytes.NewReader(body))
+				} else {
+					zr, err := zlib.NewReader(bytes.NewReader(body))
+					if err != nil {
+						return nil, &FrameError{BILIBILI, err.Error()}
+					}
+					r = zr
+				}
+				data, err := ioutil.ReadAll(io.LimitReader(r, WS_PACKAGE_MAX_LENGTH+1))
+				if err != nil {
+					return nil, &FrameError{BILIBILI, err.Error()}
+				}
+				if len(data) > WS_PACKAGE_MAX_LENGTH {
+					return nil, &FrameError{BILIBILI, "decompressed body too large"}
+				}
+				// decompressed data are complete packages
+				inner := &bilibiliReader{}
+				inner.Write(data)
+				messages, err := b.decode(inner)
+				if err != nil {
+					return nil, err
+				}
+				if inner.Len() != 0 {
+					return nil, &FrameError{BILIBILI, fmt.Sprintf("truncated package of %d bytes in compressed body", inner.Len())}
+				}
+				res = append(res, messages...)
+			default:
+				return nil, &FrameError{BILIBILI, fmt.Sprintf("unsupported protocol version %d", version)}
+			}
+		case WS_OP_CONNECT_SUCCESS:
+			logger.Infof("room init result %s", body)
+		default:
+			return nil, &FrameError{BILIBILI, fmt.Sprintf("unsupported operation %d", p.Operation)}
 		}
-	case WS_OP_CONNECT_SUCCESS:
-		logger.Infof("room init result %s", raw[16:])
-	default:
-		return nil, errors.New(fmt.Sprintf("unsupport operation %d", operation))
 	}
-	return res, nil
 }
 
 func (b *Bilibili) authenticate() error {
 	m := map[string]interface{}{
 		"clientver": "1.6.3",
 		"platform":  "web",
-		"protover":  2,
+		"protover":  WS_BODY_PROTOCOL_VERSION_BROTLI,
 		"roomid":    b.RoomID,
 		"uid":       0,
 		"type":      2,
+		"key":       b.token,
 	}
 	data, err := json.Marshal(m)
 	if err != nil {
@@ -217,7 +374,7 @@ func (b *Bilibili) authenticate() error {
 	return nil
 }
 
-func (b *Bilibili) heartBeat() {
+func (b *Bilibili) heartBeat(ctx context.Context) error {
 	defer logger.Infof("heartbeat of room %d exited", b.RoomID)
 	data := b.encode(nil, WS_OP_HEARTBEAT)
 	ticker := time.NewTicker(time.Second * 30)
@@ -227,73 +384,252 @@ func (b *Bilibili) heartBeat() {
 		case <-ticker.C:
 			err := b.Dan.WriteMessage(websocket.BinaryMessage, data)
 			if err != nil {
-				logger.Error(err)
-				b.Close()
-				return
+				return err
 			}
-		case <-b.ctx.Done():
-			return
+		case <-ctx.Done():
+			return nil
 		}
 	}
 }
 
-func (b *Bilibili) listener() {
-	defer logger.Infof("listener of room %d exited", b.RoomID)
-	for {
-		select {
-		case <-b.ctx.Done():
-			return
-		default:
-			_, raw, err := b.Dan.ReadMessage()
-			if b.Closed {
-				return
-			}
-			if err != nil {
-				logger.Error(err)
-				b.Close()
-				return
-			}
-			res, err := b.decode(raw)
-			if err != nil {
-				logger.Error(err)
-				b.Close()
-				return
-			}
-			logger.Debugf("room id %d clients %+v", b.RoomID, b.Clients)
-			for _, dan := range res {
-				_danmaku := gjson.Parse(dan)
-				if _danmaku.Get("cmd").String() == "DANMU_MSG" {
-					b.Send(&Danmaku{
-						Text:  _danmaku.Get("info.1").String(),
-						Color: "#ffffff",
-						Type:  0,
-					})
-				}
+// bilibiliDanmaku converts DANMU_MSG to danmaku, fields of info are
+// 0: [_, mode, font size, color, timestamp, ...] 1: text 2: [uid, name, admin, ...]
+// 3: [medal level, medal name, ...] 4: [user level, ...] 7: guard level
+func bilibiliDanmaku(message gjson.Result, raw string) *Danmaku {
+	info := message.Get("info")
+	var mode int
+	switch info.Get("0.1").Int() {
+	case 4:
+		mode = DANMAKU_BOTTOM
+	case 5:
+		mode = DANMAKU_TOP
+	default:
+		mode = DANMAKU_SCROLL
+	}
+	danmaku := &Danmaku{
+		Kind:      KIND_CHAT,
+		Text:      info.Get("1").String(),
+		Color:     fmt.Sprintf("#%06x", info.Get("0.3").Int()),
+		Type:      mode,
+		UID:       info.Get("2.0").String(),
+		Name:      info.Get("2.1").String(),
+		Timestamp: info.Get("0.4").Int(),
+		Level:     int(info.Get("4.0").Int()),
+		Admin:     info.Get("2.2").Int() == 1,
+		Guard:     int(info.Get("7").Int()),
+		Raw:       json.RawMessage(raw),
+	}
+	if info.Get("3.#").Int() > 0 {
+		danmaku.Medal = &Medal{
+			Name:  info.Get("3.1").String(),
+			Level: int(info.Get("3.0").Int()),
+		}
+	}
+	return danmaku
+}
+
+// bilibiliCmd is the cmd of message without its suffix, e.g. DANMU_MSG:4:0:2:2:2:0
+func bilibiliCmd(message gjson.Result) string {
+	cmd := message.Get("cmd").String()
+	if i := strings.IndexByte(cmd, ':'); i >= 0 {
+		return cmd[:i]
+	}
+	return cmd
+}
+
+// bilibiliEvent converts gift, super chat, guard, entry and status messages to danmaku,
+// gold is the paid coin of bilibili and 1000 gold is 1 cny
+func bilibiliEvent(message gjson.Result, raw string) *Danmaku {
+	data := message.Get("data")
+	danmaku := &Danmaku{
+		Color: "#ffffff",
+		Type:  DANMAKU_SCROLL,
+		UID:   data.Get("uid").String(),
+		Raw:   json.RawMessage(raw),
+	}
+	switch bilibiliCmd(message) {
+	case "SEND_GIFT":
+		danmaku.Kind = KIND_GIFT
+		danmaku.Name = data.Get("uname").String()
+		danmaku.Timestamp = data.Get("timestamp").Int() * 1000
+		danmaku.Guard = int(data.Get("guard_level").Int())
+		danmaku.Gift = &Gift{
+			ID:    data.Get("giftId").String(),
+			Name:  data.Get("giftName").String(),
+			Count: int(data.Get("num").Int()),
+		}
+		// silver is free
+		if data.Get("coin_type").String() == "gold" {
+			danmaku.Gift.Price = data.Get("total_coin").Int() / 10
+		}
+		danmaku.Text = fmt.Sprintf("%s 送出 %s x%d", danmaku.Name, danmaku.Gift.Name, danmaku.Gift.Count)
+	case "SUPER_CHAT_MESSAGE":
+		danmaku.Kind = KIND_SUPER_CHAT
+		danmaku.Text = data.Get("message").String()
+		danmaku.Name = data.Get("user_info.uname").String()
+		danmaku.Timestamp = data.Get("start_time").Int() * 1000
+		danmaku.Guard = int(data.Get("user_info.guard_level").Int())
+		danmaku.Gift = &Gift{
+			ID:       data.Get("id").String(),
+			Name:     "醒目留言",
+			Count:    1,
+			Price:    data.Get("price").Int() * 100,
+			Duration: int(data.Get("time").Int()),
+		}
+	case "GUARD_BUY":
+		danmaku.Kind = KIND_GUARD
+		danmaku.Name = data.Get("username").String()
+		danmaku.Timestamp = data.Get("start_time").Int() * 1000
+		danmaku.Guard = int(data.Get("guard_level").Int())
+		danmaku.Gift = &Gift{
+			ID:    data.Get("gift_id").String(),
+			Name:  data.Get("gift_name").String(),
+			Count: int(data.Get("num").Int()),
+			Price: data.Get("price").Int() * data.Get("num").Int() / 10,
+		}
+		danmaku.Text = fmt.Sprintf("%s 开通了 %s x%d", danmaku.Name, danmaku.Gift.Name, danmaku.Gift.Count)
+	case "INTERACT_WORD":
+		// 1 is entry, others are follow and share
+		if data.Get("msg_type").Int() != 1 {
+			return nil
+		}
+		danmaku.Kind = KIND_ENTRY
+		danmaku.Name = data.Get("uname").String()
+		danmaku.Timestamp = data.Get("timestamp").Int() * 1000
+		danmaku.Text = fmt.Sprintf("%s 进入直播间", danmaku.Name)
+	case "LIVE":
+		danmaku.Kind = KIND_STATUS
+		danmaku.Text = "直播开始"
+		danmaku.Timestamp = nowMillis()
+		danmaku.Status = &LiveStatus{Event: STATUS_LIVE}
+	case "PREPARING":
+		danmaku.Kind = KIND_STATUS
+		danmaku.Text = "直播结束"
+		danmaku.Timestamp = nowMillis()
+		danmaku.Status = &LiveStatus{Event: STATUS_OFFLINE}
+	case "ROOM_CHANGE":
+		danmaku.Kind = KIND_STATUS
+		danmaku.Text = fmt.Sprintf("房间信息更新 %s", data.Get("title").String())
+		danmaku.Timestamp = nowMillis()
+		danmaku.Status = &LiveStatus{
+			Event: STATUS_UPDATE,
+			Title: data.Get("title").String(),
+			Area:  data.Get("area_name").String(),
+		}
+	default:
+		return nil
+	}
+	// medal of sender, the field differs in messages
+	for _, path := range []string{"medal_info", "fans_medal"} {
+		medal := data.Get(path)
+		if medal.Get("medal_name").String() != "" {
+			danmaku.Medal = &Medal{
+				Name:  medal.Get("medal_name").String(),
+				Level: int(medal.Get("medal_level").Int()),
 			}
+			break
 		}
 	}
+	return danmaku
 }
 
-func (b *Bilibili) Connect() {
-	if b.Dan != nil {
-		return
+// updateStats keeps the latest stats, it returns stats danmaku on heartbeat reply
+// so that clients get stats every 30 seconds instead of every change
+func (b *Bilibili) updateStats(message gjson.Result) *Danmaku {
+	switch bilibiliCmd(message) {
+	case BilibiliHeartbeatReplyCmd:
+		b.stats.Update(func(stats *Stats) {
+			stats.Popularity = message.Get("popularity").Int()
+		})
+		return &Danmaku{
+			Kind:      KIND_STATS,
+			Color:     "#ffffff",
+			Type:      DANMAKU_SCROLL,
+			Timestamp: nowMillis(),
+			Stats:     b.GetStats(),
+		}
+	case "WATCHED_CHANGE":
+		b.stats.Update(func(stats *Stats) {
+			stats.Watched = message.Get("data.num").Int()
+		})
+	case "ONLINE_RANK_COUNT":
+		b.stats.Update(func(stats *Stats) {
+			stats.Online = message.Get("data.count").Int()
+		})
+	}
+	return nil
+}
+
+// handle converts messages of a frame to danmaku, stats are sent on heartbeat reply only
+func (b *Bilibili) handle(raw []byte) ([]*Danmaku, error) {
+	b.reader.Write(raw)
+	res, err := b.decode(b.reader)
+	if err != nil {
+		return nil, err
+	}
+	var danmakus []*Danmaku
+	for _, dan := range res {
+		message := gjson.Parse(dan)
+		var danmaku *Danmaku
+		switch bilibiliCmd(message) {
+		case "DANMU_MSG":
+			danmaku = bilibiliDanmaku(message, dan)
+		case BilibiliHeartbeatReplyCmd, "WATCHED_CHANGE", "ONLINE_RANK_COUNT":
+			danmaku = b.updateStats(message)
+		default:
+			danmaku = bilibiliEvent(message, dan)
+		}
+		if danmaku != nil {
+			danmakus = append(danmakus, danmaku)
+		}
 	}
-	conn, _, err := websocket.DefaultDialer.Dial(BilibiliDanmakuUrl, nil)
+	return danmakus, nil
+}
+
+// danmakuServers gets danmaku token and servers of the room, the default server
+// is used as the last one
+func (b *Bilibili) danmakuServers() []string {
+	var servers []string
+	res, err := util.Request("GET", fmt.Sprintf(BilibiliServerUrl, b.RoomID), "", nil)
 	if err != nil {
 		logger.Error(err)
-		return
+		return []string{BilibiliDanmakuUrl}
+	}
+	data := gjson.ParseBytes(res)
+	b.token = data.Get("data.token").String()
+	data.Get("data.host_list").ForEach(func(key, value gjson.Result) bool {
+		servers = append(servers, fmt.Sprintf(BilibiliHostUrl, value.Get("host").String(), value.Get("wss_port").Int()))
+		return true
+	})
+	return append(servers, BilibiliDanmakuUrl)
+}
+
+// dial connects to the first available server and authenticates, a new token is
+// got every time since the old one may be expired
+func (b *Bilibili) dial() error {
+	var conn *websocket.Conn
+	var err error
+	for _, server := range b.danmakuServers() {
+		conn, _, err = websocket.DefaultDialer.Dial(server, nil)
+		if err == nil {
+			break
+		}
+		logger.Errorf("connect to danmaku server %s failed: %v", server, err)
+	}
+	if err != nil {
+		return err
 	}
 	logger.Infof("connect to danmaku %d", b.RoomID)
 	b.Dan = conn
-	b.ctx, b.cancel = context.WithCancel(context.Background())
-	// start listener
-	go b.listener()
+	b.reader = &bilibiliReader{}
 	err = b.authenticate()
 	if err != nil {
-		logger.Error(err)
-		b.Close()
-		return
+		_ = conn.Close()
+		return err
 	}
-	// start heartbeat
-	go b.heartBeat()
+	return nil
+}
+
+func (b *Bilibili) serve(ctx context.Context) error {
+	return serveConn(ctx, b.Dan, b.listen(b.Dan, b.handle), b.heartBeat)
 }
@@ -0,0 +1,447 @@
+package platform
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+)
+
+// bilibiliFrame makes a package with header of version and operation
+func bilibiliFrame(version uint16, op uint32, body []byte) []byte {
+	header := make([]byte, WS_PACKAGE_HEADER_TOTAL_LENGTH)
+	binary.BigEndian.PutUint32(header[0:], uint32(len(header)+len(body)))
+	binary.BigEndian.PutUint16(header[4:], WS_PACKAGE_HEADER_TOTAL_LENGTH)
+	binary.BigEndian.PutUint16(header[6:], version)
+	binary.BigEndian.PutUint32(header[8:], op)
+	binary.BigEndian.PutUint32(header[12:], 1)
+	return append(header, body...)
+}
+
+func zlibBody(data []byte) []byte {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	_, _ = w.Write(data)
+	_ = w.Close()
+	return b.Bytes()
+}
+
+func brotliBody(data []byte) []byte {
+	var b bytes.Buffer
+	w := brotli.NewWriter(&b)
+	_, _ = w.Write(data)
+	_ = w.Close()
+	return b.Bytes()
+}
+
+// messages in the shape of what the danmaku server pushes
+const (
+	bilibiliDanmakuMsg   = `{"cmd":"DANMU_MSG","info":[[0,1,25,16777215,1600000000000,0,0,"",0,0,0],"hello",[1,"user",0,0,0,10000,1,""],[5,"medal","streamer",1,0,"",0],[10,0,0,">50000"],["",""],0,0,null,{"ts":1600000000,"ct":"0"}]}`
+	bilibiliGiftMsg      = `{"cmd":"SEND_GIFT","data":{"giftId":1,"giftName":"辣条","num":3,"price":100,"coin_type":"gold","uid":2,"uname":"user2","timestamp":1600000000}}`
+	bilibiliInteractMsg  = `{"cmd":"INTERACT_WORD","data":{"uid":3,"uname":"user3","msg_type":1,"timestamp":1600000000}}`
+	bilibiliConnectReply = `{"code":0}`
+)
+
+func TestBilibiliDecode(t *testing.T) {
+	danmaku := bilibiliFrame(WS_BODY_PROTOCOL_VERSION_NORMAL, WS_OP_MESSAGE, []byte(bilibiliDanmakuMsg))
+	gift := bilibiliFrame(WS_BODY_PROTOCOL_VERSION_NORMAL, WS_OP_MESSAGE, []byte(bilibiliGiftMsg))
+	interact := bilibiliFrame(WS_BODY_PROTOCOL_VERSION_NORMAL, WS_OP_MESSAGE, []byte(bilibiliInteractMsg))
+	packages := append(append(append([]byte{}, danmaku...), gift...), interact...)
+	tests := []struct {
+		name     string
+		messages [][]byte
+		want     []string
+		err      bool
+	}{
+		{
+			name:     "version 0 json",
+			messages: [][]byte{danmaku},
+			want:     []string{bilibiliDanmakuMsg},
+		},
+		{
+			name:     "version 1 heartbeat reply",
+			messages: [][]byte{bilibiliFrame(WS_BODY_PROTOCOL_VERSION_INT, WS_OP_HEARTBEAT_REPLY, []byte{0, 1, 0x86, 0xa0})},
+			want:     []string{`{"cmd":"HEARTBEAT_REPLY","popularity":100000}`},
+		},
+		{
+			name:     "version 2 zlib with packages",
+			messages: [][]byte{bilibiliFrame(WS_BODY_PROTOCOL_VERSION_DEFLATE, WS_OP_MESSAGE, zlibBody(append(append([]byte{}, danmaku...), gift...)))},
+			want:     []string{bilibiliDanmakuMsg, bilibiliGiftMsg},
+		},
+		{
+			name:     "version 3 brotli with packages",
+			messages: [][]byte{bilibiliFrame(WS_BODY_PROTOCOL_VERSION_BROTLI, WS_OP_MESSAGE, brotliBody(packages))},
+			want:     []string{bilibiliDanmakuMsg, bilibiliGiftMsg, bilibiliInteractMsg},
+		},
+		{
+			name:     "packages in one message",
+			messages: [][]byte{packages},
+			want:     []string{bilibiliDanmakuMsg, bilibiliGiftMsg, bilibiliInteractMsg},
+		},
+		{
+			name:     "package split into messages",
+			messages: [][]byte{packages[:10], packages[10 : len(danmaku)+5], packages[len(danmaku)+5:]},
+			want:     []string{bilibiliDanmakuMsg, bilibiliGiftMsg, bilibiliInteractMsg},
+		},
+		{
+			name:     "connect success",
+			messages: [][]byte{bilibiliFrame(WS_BODY_PROTOCOL_VERSION_INT, WS_OP_CONNECT_SUCCESS, []byte(bilibiliConnectReply))},
+		},
+		{
+			name:     "unsupported version",
+			messages: [][]byte{bilibiliFrame(4, WS_OP_MESSAGE, []byte(bilibiliDanmakuMsg))},
+			err:      true,
+		},
+		{
+			name:     "unsupported operation",
+			messages: [][]byte{bilibiliFrame(WS_BODY_PROTOCOL_VERSION_NORMAL, 100, nil)},
+			err:      true,
+		},
+		{
+			name:     "truncated package in compressed body",
+			messages: [][]byte{bilibiliFrame(WS_BODY_PROTOCOL_VERSION_BROTLI, WS_OP_MESSAGE, brotliBody(packages[:len(packages)-1]))},
+			err:      true,
+		},
+		{
+			name:     "invalid zlib body",
+			messages: [][]byte{bilibiliFrame(WS_BODY_PROTOCOL_VERSION_DEFLATE, WS_OP_MESSAGE, []byte("not zlib"))},
+			err:      true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &Bilibili{}
+			r := &bilibiliReader{}
+			var got []string
+			var err error
+			for _, message := range test.messages {
+				r.Write(message)
+				var messages []string
+				messages, err = b.decode(r)
+				if err != nil {
+					break
+				}
+				got = append(got, messages...)
+			}
+			if test.err {
+				if _, ok := err.(*FrameError); !ok {
+					t.Fatalf("got error %v, want a frame error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if r.Len() != 0 {
+				t.Errorf("%d bytes left", r.Len())
+			}
+		})
+	}
+}
+
+// TestBilibiliDecodeSplit feeds frames split at every point and truncated to every length,
+// the reader never panics and fails with frame errors only
+func TestBilibiliDecodeSplit(t *testing.T) {
+	message := bilibiliFrame(WS_BODY_PROTOCOL_VERSION_NORMAL, WS_OP_MESSAGE, []byte(`{"cmd":"DANMU_MSG"}`))
+	heartbeat := bilibiliFrame(WS_BODY_PROTOCOL_VERSION_INT, WS_OP_HEARTBEAT_REPLY, []byte{0, 0, 0, 1})
+	compressed := bilibiliFrame(WS_BODY_PROTOCOL_VERSION_DEFLATE, WS_OP_MESSAGE, zlibBody(append(message, message...)))
+	oversized := bilibiliFrame(WS_BODY_PROTOCOL_VERSION_NORMAL, WS_OP_MESSAGE, nil)
+	binary.BigEndian.PutUint32(oversized, WS_PACKAGE_MAX_LENGTH+1)
+	badHeader := bilibiliFrame(WS_BODY_PROTOCOL_VERSION_NORMAL, WS_OP_MESSAGE, nil)
+	binary.BigEndian.PutUint16(badHeader[4:], 4)
+	frames := [][]byte{
+		append(message, heartbeat...),
+		compressed,
+		// short frames
+		bilibiliFrame(WS_BODY_PROTOCOL_VERSION_INT, WS_OP_HEARTBEAT_REPLY, []byte{1}),
+		bilibiliFrame(WS_BODY_PROTOCOL_VERSION_DEFLATE, WS_OP_MESSAGE, zlibBody(message[:20])),
+		// oversized frames
+		oversized,
+		badHeader,
+	}
+	b := &Bilibili{}
+	for _, frame := range frames {
+		for n := 0; n <= len(frame); n++ {
+			data := frame[:n]
+			for split := 0; split <= n; split++ {
+				r := &bilibiliReader{}
+				for _, part := range [][]byte{data[:split], data[split:]} {
+					r.Write(part)
+					if _, err := b.decode(r); err != nil {
+						if _, ok := err.(*FrameError); !ok {
+							t.Fatalf("error %v is not a frame error", err)
+						}
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestBilibiliCmd(t *testing.T) {
+	for message, want := range map[string]string{
+		`{"cmd":"DANMU_MSG"}`:             "DANMU_MSG",
+		`{"cmd":"DANMU_MSG:4:0:2:2:2:0"}`: "DANMU_MSG",
+		`{"cmd":""}`:                      "",
+		`{}`:                              "",
+	} {
+		if cmd := bilibiliCmd(gjson.Parse(message)); cmd != want {
+			t.Errorf("%s: got %s, want %s", message, cmd, want)
+		}
+	}
+}
+
+func TestBilibiliEvent(t *testing.T) {
+	tests := []struct {
+		message string
+		want    *Danmaku
+	}{
+		{
+			message: `{"cmd":"SEND_GIFT","data":{"giftId":31036,"giftName":"小花花","num":5,"total_coin":500,"coin_type":"gold","uid":2,"uname":"user2","guard_level":3,"timestamp":1600000000,` +
+				`"medal_info":{"medal_name":"medal","medal_level":12}}}`,
+			want: &Danmaku{Kind: KIND_GIFT, Text: "user2 送出 小花花 x5", UID: "2", Name: "user2", Timestamp: 1600000000000, Guard: 3,
+				Medal: &Medal{Name: "medal", Level: 12}, Gift: &Gift{ID: "31036", Name: "小花花", Count: 5, Price: 50}},
+		},
+		{
+			message: `{"cmd":"SEND_GIFT","data":{"giftId":1,"giftName":"辣条","num":3,"total_coin":300,"coin_type":"silver","uid":2,"uname":"user2","timestamp":1600000000}}`,
+			want:    &Danmaku{Kind: KIND_GIFT, Text: "user2 送出 辣条 x3", UID: "2", Name: "user2", Timestamp: 1600000000000, Gift: &Gift{ID: "1", Name: "辣条", Count: 3}},
+		},
+		{
+			message: `{"cmd":"SUPER_CHAT_MESSAGE","data":{"id":7,"uid":4,"message":"hello","price":30,"time":60,"start_time":1600000000,` +
+				`"user_info":{"uname":"user4","guard_level":2},"medal_info":{"medal_name":"","medal_level":0}}}`,
+			want: &Danmaku{Kind: KIND_SUPER_CHAT, Text: "hello", UID: "4", Name: "user4", Timestamp: 1600000000000, Guard: 2,
+				Gift: &Gift{ID: "7", Name: "醒目留言", Count: 1, Price: 3000, Duration: 60}},
+		},
+		{
+			message: `{"cmd":"GUARD_BUY","data":{"uid":5,"username":"user5","guard_level":3,"num":2,"price":198000,"gift_id":10003,"gift_name":"舰长","start_time":1600000000}}`,
+			want: &Danmaku{Kind: KIND_GUARD, Text: "user5 开通了 舰长 x2", UID: "5", Name: "user5", Timestamp: 1600000000000, Guard: 3,
+				Gift: &Gift{ID: "10003", Name: "舰长", Count: 2, Price: 39600}},
+		},
+		{
+			message: `{"cmd":"INTERACT_WORD","data":{"uid":3,"uname":"user3","msg_type":1,"timestamp":1600000000,"fans_medal":{"medal_name":"fans","medal_level":3}}}`,
+			want:    &Danmaku{Kind: KIND_ENTRY, Text: "user3 进入直播间", UID: "3", Name: "user3", Timestamp: 1600000000000, Medal: &Medal{Name: "fans", Level: 3}},
+		},
+		// follow
+		{message: `{"cmd":"INTERACT_WORD","data":{"uid":3,"uname":"user3","msg_type":2,"timestamp":1600000000}}`},
+		{
+			message: `{"cmd":"LIVE","roomid":1}`,
+			want:    &Danmaku{Kind: KIND_STATUS, Text: "直播开始", Status: &LiveStatus{Event: STATUS_LIVE}},
+		},
+		{
+			message: `{"cmd":"PREPARING","roomid":"1"}`,
+			want:    &Danmaku{Kind: KIND_STATUS, Text: "直播结束", Status: &LiveStatus{Event: STATUS_OFFLINE}},
+		},
+		{
+			message: `{"cmd":"ROOM_CHANGE","data":{"title":"new title","area_name":"单机游戏"}}`,
+			want:    &Danmaku{Kind: KIND_STATUS, Text: "房间信息更新 new title", Status: &LiveStatus{Event: STATUS_UPDATE, Title: "new title", Area: "单机游戏"}},
+		},
+		// cmd with a suffix
+		{
+			message: `{"cmd":"SEND_GIFT:1:0","data":{"giftId":1,"giftName":"辣条","num":1,"coin_type":"silver","uid":2,"uname":"user2","timestamp":1600000000}}`,
+			want:    &Danmaku{Kind: KIND_GIFT, Text: "user2 送出 辣条 x1", UID: "2", Name: "user2", Timestamp: 1600000000000, Gift: &Gift{ID: "1", Name: "辣条", Count: 1}},
+		},
+		{message: `{"cmd":"STOP_LIVE_ROOM_LIST","data":{}}`},
+	}
+	for _, tt := range tests {
+		danmaku := bilibiliEvent(gjson.Parse(tt.message), tt.message)
+		if tt.want == nil {
+			if danmaku != nil {
+				t.Errorf("%s: got %+v, want nil", tt.message, danmaku)
+			}
+			continue
+		}
+		if danmaku == nil {
+			t.Errorf("%s: got nil", tt.message)
+			continue
+		}
+		if string(danmaku.Raw) != tt.message {
+			t.Errorf("%s: raw %s", tt.message, danmaku.Raw)
+		}
+		danmaku.Raw = nil
+		// status events are stamped when received
+		if danmaku.Status != nil {
+			danmaku.Timestamp = 0
+		}
+		tt.want.Color, tt.want.Type = "#ffffff", DANMAKU_SCROLL
+		if !reflect.DeepEqual(danmaku, tt.want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", tt.message, danmaku, tt.want)
+		}
+	}
+}
+
+func TestBilibiliUpdateStats(t *testing.T) {
+	b := &Bilibili{BaseRoom: newBaseRoom(BILIBILI, "1", nil)}
+	tests := []struct {
+		message string
+		stats   *Stats
+		// heartbeat replies send stats
+		send bool
+	}{
+		{message: `{"cmd":"WATCHED_CHANGE","data":{"num":1000,"text_small":"1000"}}`, stats: &Stats{Watched: 1000}},
+		{message: `{"cmd":"ONLINE_RANK_COUNT:1","data":{"count":20}}`, stats: &Stats{Watched: 1000, Online: 20}},
+		{message: `{"cmd":"HEARTBEAT_REPLY","popularity":5}`, stats: &Stats{Popularity: 5, Watched: 1000, Online: 20}, send: true},
+		{message: `{"cmd":"ONLINE_RANK_COUNT","data":{"count":30}}`, stats: &Stats{Popularity: 5, Watched: 1000, Online: 30}},
+	}
+	for _, tt := range tests {
+		danmaku := b.updateStats(gjson.Parse(tt.message))
+		if !reflect.DeepEqual(b.GetStats(), tt.stats) {
+			t.Errorf("%s: stats %+v, want %+v", tt.message, b.GetStats(), tt.stats)
+		}
+		if (danmaku != nil) != tt.send {
+			t.Errorf("%s: got %+v", tt.message, danmaku)
+			continue
+		}
+		if danmaku != nil && (danmaku.Kind != KIND_STATS || !reflect.DeepEqual(danmaku.Stats, tt.stats)) {
+			t.Errorf("%s: got %+v", tt.message, danmaku)
+		}
+	}
+}
+
+// the playurl in testdata is reconstructed from the layout of getRoomPlayInfo v2, signs are fake
+func TestBilibiliStreams(t *testing.T) {
+	playurl := gjson.GetBytes(fixture(t, "bilibili_playurl.json"), "data.playurl_info.playurl")
+	streams := bilibiliStreams(playurl)
+	type stream struct {
+		protocol, format, codec string
+		cdns                    []string
+	}
+	want := []stream{
+		{PROTOCOL_HTTP_STREAM, FORMAT_FLV, CODEC_AVC, []string{"cn-gddg-ct-01-01", "d1--cn-gotcha03"}},
+		{PROTOCOL_HTTP_HLS, FORMAT_TS, CODEC_AVC, []string{"cn-gddg-ct-01-02"}},
+		{PROTOCOL_HTTP_HLS, FORMAT_FMP4, CODEC_AVC, []string{"cn-gddg-ct-01-03"}},
+		// av1 has no lines and is left out
+		{PROTOCOL_HTTP_HLS, FORMAT_FMP4, CODEC_HEVC, []string{"cn-gddg-ct-01-04"}},
+	}
+	var got []stream
+	for _, s := range streams {
+		if s.Quality != 10000 {
+			t.Errorf("%s %s %s: quality %d", s.Protocol, s.Format, s.Codec, s.Quality)
+		}
+		var cdns []string
+		for _, link := range s.Links {
+			if !strings.HasPrefix(link.URL, "https://"+link.Host+"/live-bvc/000000/live_1_0000000") || !strings.Contains(link.URL, "?expires=1700003600&") {
+				t.Errorf("%s %s %s: link %s", s.Protocol, s.Format, s.Codec, link.URL)
+			}
+			cdns = append(cdns, link.CDN)
+		}
+		got = append(got, stream{s.Protocol, s.Format, s.Codec, cdns})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got streams %+v, want %+v", got, want)
+	}
+	// streams chosen by preference
+	for preference, want := range map[StreamPreference]int{
+		{}:                                 0,
+		{Protocol: PROTOCOL_HTTP_HLS}:      1,
+		{Format: FORMAT_FMP4}:              2,
+		{Codec: CODEC_HEVC}:                3,
+		{Format: FORMAT_FLV, Codec: "av1"}: 0,
+	} {
+		if got := preference.Choose(streams); got != want {
+			t.Errorf("%+v: chose %d, want %d", preference, got, want)
+		}
+	}
+}
+
+// bilibiliAuth is an authentication received by the local danmaku server at path
+type bilibiliAuth struct {
+	path string
+	body map[string]interface{}
+}
+
+// bilibiliServers stands in for getDanmuInfo and danmaku servers, host_list has a server
+// refusing connections before the local one at /sub, the default server is at /default
+func bilibiliServers(t *testing.T) <-chan bilibiliAuth {
+	auths := make(chan bilibiliAuth, 4)
+	upgrader := websocket.Upgrader{}
+	// a port nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+	var port int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/getDanmuInfo" {
+			_, _ = fmt.Fprintf(w, `{"code":0,"data":{"token":"token","host_list":[{"host":"127.0.0.1","wss_port":%d},{"host":"127.0.0.1","wss_port":%d}]}}`, closed, port)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, raw, err := conn.ReadMessage()
+		if err != nil || len(raw) < WS_PACKAGE_HEADER_TOTAL_LENGTH ||
+			binary.BigEndian.Uint32(raw[8:]) != WS_OP_USER_AUTHENTICATION {
+			return
+		}
+		var body map[string]interface{}
+		if json.Unmarshal(raw[WS_PACKAGE_HEADER_TOTAL_LENGTH:], &body) == nil {
+			auths <- bilibiliAuth{path: r.URL.Path, body: body}
+		}
+	}))
+	t.Cleanup(server.Close)
+	port = server.Listener.Addr().(*net.TCPAddr).Port
+	danmakuUrl, serverUrl, hostUrl := BilibiliDanmakuUrl, BilibiliServerUrl, BilibiliHostUrl
+	BilibiliDanmakuUrl = "ws" + strings.TrimPrefix(server.URL, "http") + "/default"
+	BilibiliServerUrl = server.URL + "/getDanmuInfo?id=%d"
+	BilibiliHostUrl = "ws://%s:%d/sub"
+	t.Cleanup(func() {
+		BilibiliDanmakuUrl, BilibiliServerUrl, BilibiliHostUrl = danmakuUrl, serverUrl, hostUrl
+	})
+	return auths
+}
+
+func TestBilibiliDial(t *testing.T) {
+	auths := bilibiliServers(t)
+	b := &Bilibili{RoomID: 1}
+	servers := b.danmakuServers()
+	if len(servers) != 3 || servers[2] != BilibiliDanmakuUrl || b.token != "token" {
+		t.Fatalf("got servers %q token %q", servers, b.token)
+	}
+	tests := []struct {
+		name      string
+		serverUrl string
+		path      string
+		key       string
+	}{
+		// the first host fails, the next one gets the same key
+		{name: "failover", serverUrl: BilibiliServerUrl, path: "/sub", key: "token"},
+		// no host list, the default server is dialed without key
+		{name: "default", serverUrl: "http://127.0.0.1:1/getDanmuInfo?id=%d", path: "/default"},
+	}
+	for _, tt := range tests {
+		BilibiliServerUrl = tt.serverUrl
+		b := &Bilibili{RoomID: 1}
+		if err := b.dial(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		select {
+		case auth := <-auths:
+			if auth.path != tt.path || auth.body["key"] != tt.key || auth.body["roomid"] != float64(1) {
+				t.Errorf("%s: got auth %+v", tt.name, auth)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: no auth received", tt.name)
+		}
+		_ = b.Dan.Close()
+	}
+}
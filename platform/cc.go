@@ -0,0 +1,284 @@
+package platform
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"live/util"
+	"math/rand"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+const (
+	CCBaseUrl    = "https://cc.163.com/%s/"
+	CCDanmakuUrl = "wss://weblink.cc.163.com/"
+)
+
+// sid and cid of cc frames
+const (
+	CC_SID_CLIENT    = 6144
+	CC_CID_REGISTER  = 2
+	CC_CID_HEARTBEAT = 5
+	CC_SID_ROOM      = 512
+	CC_CID_JOIN      = 1
+	CC_CID_CHAT      = 32785
+)
+
+var CCNextDataRe = regexp.MustCompile(`<script id="__NEXT_DATA__"[^>]*>\s*\{`)
+
+// stream resolutions from high to low
+var CCQualities = []struct {
+	Key         string
+	Description string
+}{
+	{"original", "原画"},
+	{"blueray", "蓝光"},
+	{"ultra", "超清"},
+	{"high", "高清"},
+	{"standard", "标清"},
+}
+
+const CC Type = 7
+
+var CCRoomUrlRe = regexp.MustCompile(`^(?:www\.|h5\.)?cc\.163\.com/(?:cc/)?(\d+)`)
+
+func init() {
+	Register(&Adapter{
+		Type:         CC,
+		Name:         "cc",
+		Capabilities: Capabilities{Danmaku: true},
+		URL:          CCRoomUrlRe,
+		New:          GetNeteaseCCRoom,
+	})
+}
+
+type NeteaseCC struct {
+	*BaseRoom
+	RoomID  string
+	Quality uint
+	Status  int
+	Dan     *websocket.Conn
+	// live info in room page
+	live gjson.Result
+}
+
+func GetNeteaseCCRoom(id string, quality uint, client *websocket.Conn) (Room, error) {
+	html, err := util.Request("GET", fmt.Sprintf(CCBaseUrl, url.PathEscape(id)), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := pageJSON(html, CCNextDataRe)
+	if err != nil {
+		return nil, err
+	}
+	info := data.Get("props.pageProps.roomInfoInitData")
+	if !info.Exists() {
+		return nil, errors.New(fmt.Sprintf("room %s not found", id))
+	}
+	live := info.Get("live")
+	status := 0
+	if live.Get("quickplay").Exists() {
+		status = 1
+	}
+	if client == nil {
+		return &NeteaseCC{
+			RoomID:  id,
+			Quality: quality,
+			Status:  status,
+			live:    live,
+		}, nil
+	}
+	return joinRoom(roomIndex(CC, id), func() Room {
+		room := &NeteaseCC{
+			RoomID: id,
+			live:   live,
+		}
+		room.BaseRoom = newBaseRoom(CC, id, room)
+		return room
+	}, client), nil
+}
+
+func (c *NeteaseCC) GetLiveInfo() (*Platform, error) {
+	if c.Status != 1 {
+		return &Platform{
+			Type:           CC,
+			RoomID:         c.RoomID,
+			Status:         0,
+			CurrentQuality: c.Quality,
+			Title:          c.live.Get("title").String(),
+		}, nil
+	}
+	// quality is the vbr of resolution, the best one is the default
+	var qualities []Quality
+	link := ""
+	for _, quality := range CCQualities {
+		resolution := c.live.Get("quickplay.resolution." + quality.Key)
+		if !resolution.Exists() {
+			continue
+		}
+		vbr := resolution.Get("vbr").Uint()
+		qualities = append(qualities, Quality{
+			Quality:     vbr,
+			Description: quality.Description,
+		})
+		// every cdn serves the same stream, take the first one
+		cdn := ""
+		resolution.Get("cdn").ForEach(func(key, value gjson.Result) bool {
+			cdn = value.String()
+			return false
+		})
+		if link == "" || uint64(c.Quality) == vbr {
+			link = cdn
+		}
+	}
+	return &Platform{
+		Type:           CC,
+		RoomID:         c.RoomID,
+		Status:         uint(c.Status),
+		CurrentQuality: c.Quality,
+		Link:           link,
+		Qualities:      qualities,
+		Title:          c.live.Get("title").String(),
+	}, nil
+}
+
+// danmaku data structure
+// +-------+-------+------------+--------------------+
+// |  SID  |  CID  |   UNUSED   |        DATA        |
+// +-------+-------+------------+--------------------+
+// |   2   |   2   |     4      |  msgpack encoded   |
+// +-------+-------+------------+--------------------+
+// chat messages are maps in the "msg" list, 4 is content, 7 is uid and 197 is nickname
+// note: data in head are little endian
+func (c *NeteaseCC) encode(data map[string]interface{}, sid, cid int) ([]byte, error) {
+	body, err := mpMarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint16(header[0:], uint16(sid))
+	binary.LittleEndian.PutUint16(header[2:], uint16(cid))
+	return append(header, body...), nil
+}
+
+func (c *NeteaseCC) decode(raw []byte) ([]mpMap, error) {
+	if len(raw) < 8 {
+		return nil, errors.New(fmt.Sprintf("invalid cc frame length %d", len(raw)))
+	}
+	sid, cid := binary.LittleEndian.Uint16(raw[0:]), binary.LittleEndian.Uint16(raw[2:])
+	if sid != CC_SID_ROOM || cid != CC_CID_CHAT {
+		return nil, nil
+	}
+	v, err := mpUnmarshal(raw[8:])
+	if err != nil {
+		return nil, err
+	}
+	body, _ := v.(mpMap)
+	var res []mpMap
+	for _, item := range body.List("msg") {
+		if message, ok := item.(mpMap); ok {
+			res = append(res, message)
+		}
+	}
+	return res, nil
+}
+
+func ccDanmaku(message mpMap) *Danmaku {
+	uid := message.String(7)
+	if id, ok := message.Get(7).(int64); ok {
+		uid = fmt.Sprint(id)
+	}
+	return &Danmaku{
+		Kind:      KIND_CHAT,
+		Text:      message.String(4),
+		Color:     "#ffffff",
+		Type:      DANMAKU_SCROLL,
+		Name:      message.String(197),
+		UID:       uid,
+		Timestamp: nowMillis(),
+	}
+}
+
+func (c *NeteaseCC) authenticate() error {
+	register, err := c.encode(map[string]interface{}{
+		"web-cc":       time.Now().UnixNano() / int64(time.Millisecond),
+		"device_token": fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64()),
+		"system":       "win",
+		"memory":       1,
+		"version":      1,
+		"webccType":    4253,
+		"update":       0,
+	}, CC_SID_CLIENT, CC_CID_REGISTER)
+	if err != nil {
+		return err
+	}
+	err = c.Dan.WriteMessage(websocket.BinaryMessage, register)
+	if err != nil {
+		return err
+	}
+	// join room to receive chat
+	join, err := c.encode(map[string]interface{}{
+		"cid":      c.live.Get("channel_id").Int(),
+		"gametype": c.live.Get("gametype").Int(),
+		"roomId":   c.live.Get("room_id").Int(),
+	}, CC_SID_ROOM, CC_CID_JOIN)
+	if err != nil {
+		return err
+	}
+	return c.Dan.WriteMessage(websocket.BinaryMessage, join)
+}
+
+func (c *NeteaseCC) heartBeat(ctx context.Context) error {
+	defer logger.Infof("heartbeat of room %s exited", c.RoomID)
+	data, _ := c.encode(map[string]interface{}{}, CC_SID_CLIENT, CC_CID_HEARTBEAT)
+	ticker := time.NewTicker(time.Second * 30)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := c.Dan.WriteMessage(websocket.BinaryMessage, data)
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// handle converts chat messages of a frame to danmaku
+func (c *NeteaseCC) handle(raw []byte) ([]*Danmaku, error) {
+	res, err := c.decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	var danmakus []*Danmaku
+	for _, message := range res {
+		danmakus = append(danmakus, ccDanmaku(message))
+	}
+	return danmakus, nil
+}
+
+func (c *NeteaseCC) dial() error {
+	conn, _, err := websocket.DefaultDialer.Dial(CCDanmakuUrl, nil)
+	if err != nil {
+		return err
+	}
+	logger.Infof("connect to danmaku %s", c.RoomID)
+	c.Dan = conn
+	err = c.authenticate()
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *NeteaseCC) serve(ctx context.Context) error {
+	return serveConn(ctx, c.Dan, c.listen(c.Dan, c.handle), c.heartBeat)
+}
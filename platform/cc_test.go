@@ -0,0 +1,145 @@
+package platform
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	long := string(make([]byte, 300))
+	items := make([]interface{}, 20)
+	for i := range items {
+		items[i] = int64(i)
+	}
+	tests := []struct {
+		value interface{}
+		want  interface{}
+	}{
+		{value: nil},
+		{value: true, want: true},
+		{value: false, want: false},
+		{value: 1, want: int64(1)},
+		{value: -1, want: int64(-1)},
+		{value: -100, want: int64(-100)},
+		{value: int64(1) << 40, want: int64(1) << 40},
+		{value: 1.5, want: 1.5},
+		{value: "hello", want: "hello"},
+		{value: long, want: long},
+		{value: items, want: items},
+		{
+			value: map[string]interface{}{"msg": []interface{}{map[string]interface{}{"4": "text"}}},
+			want:  mpMap{"msg": []interface{}{mpMap{"4": "text"}}},
+		},
+	}
+	for _, tt := range tests {
+		data, err := mpMarshal(tt.value)
+		if err != nil {
+			t.Fatalf("marshal %v: %v", tt.value, err)
+		}
+		v, err := mpUnmarshal(data)
+		if err != nil {
+			t.Fatalf("unmarshal %v: %v", tt.value, err)
+		}
+		if !reflect.DeepEqual(v, tt.want) {
+			t.Errorf("got %#v, want %#v", v, tt.want)
+		}
+	}
+}
+
+func TestMsgpackUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want interface{}
+		err  bool
+	}{
+		{name: "int keys", data: []byte{0x82, 0x04, 0xa2, 'h', 'i', 0xcc, 0xc5, 0xa1, 'u'}, want: mpMap{int64(4): "hi", int64(197): "u"}},
+		{name: "uint16", data: []byte{0xcd, 0x01, 0x00}, want: int64(256)},
+		{name: "bin8", data: []byte{0xc4, 0x02, 'o', 'k'}, want: "ok"},
+		{name: "fixext", data: []byte{0x92, 0xd4, 0x01, 0xff, 0x01}, want: []interface{}{nil, int64(1)}},
+		{name: "fixext16", data: append(append([]byte{0x92, 0xd8, 0x01}, make([]byte, 16)...), 0x01), want: []interface{}{nil, int64(1)}},
+		{name: "ext8", data: []byte{0x82, 0xa1, 'e', 0xc7, 0x03, 0x01, 1, 2, 3, 0xa1, 'n', 0x02}, want: mpMap{"e": nil, "n": int64(2)}},
+		{name: "ext16", data: []byte{0x92, 0xc8, 0x00, 0x01, 0x05, 0xff, 0xc3}, want: []interface{}{nil, true}},
+		{name: "truncated string", data: []byte{0xa5, 'h', 'i'}, err: true},
+		{name: "truncated map", data: []byte{0x82, 0x04}, err: true},
+		{name: "truncated array", data: []byte{0xdc, 0x00}, err: true},
+		{name: "truncated fixext", data: []byte{0xd6, 0x01, 0x00}, err: true},
+		{name: "truncated ext", data: []byte{0xc7, 0x04, 0x01, 0x00}, err: true},
+		{name: "ext length", data: []byte{0xc9, 0xff, 0xff, 0xff, 0xff, 0x01}, err: true},
+		{name: "array length", data: []byte{0xdd, 0xff, 0xff, 0xff, 0xff}, err: true},
+		{name: "never used", data: []byte{0xc1}, err: true},
+		{name: "empty", err: true},
+	}
+	for _, tt := range tests {
+		v, err := mpUnmarshal(tt.data)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if !tt.err && !reflect.DeepEqual(v, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, v, tt.want)
+		}
+	}
+}
+
+// ccChat makes a chat frame with a message of every text, the sender is uid 42,
+// messages are keyed by integers which mpMarshal doesn't write
+func ccChat(texts ...string) []byte {
+	buf := &bytes.Buffer{}
+	mpWriteLength(buf, 1, 0x80, 0xde)
+	_ = mpWrite(buf, "msg")
+	mpWriteLength(buf, len(texts), 0x90, 0xdc)
+	for _, text := range texts {
+		mpWriteLength(buf, 3, 0x80, 0xde)
+		for _, v := range []interface{}{4, text, 7, 42, 197, "user"} {
+			_ = mpWrite(buf, v)
+		}
+	}
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint16(header[0:], CC_SID_ROOM)
+	binary.LittleEndian.PutUint16(header[2:], CC_CID_CHAT)
+	return append(header, buf.Bytes()...)
+}
+
+func TestCCDecode(t *testing.T) {
+	heartbeat, _ := (&NeteaseCC{}).encode(map[string]interface{}{}, CC_SID_CLIENT, CC_CID_HEARTBEAT)
+	// a sample chat frame keyed by integers and carrying an ext value
+	sample := []byte{0, 0, 0, 0, 0, 0, 0, 0,
+		0x81, 0xa3, 'm', 's', 'g', 0x91,
+		0x84, 0x04, 0xa2, 'h', 'i', 0x07, 0xcd, 0x30, 0x39, 0xcc, 0xc5, 0xa1, 'u', 0x10, 0xd4, 0x01, 0x00}
+	binary.LittleEndian.PutUint16(sample[0:], CC_SID_ROOM)
+	binary.LittleEndian.PutUint16(sample[2:], CC_CID_CHAT)
+	chat := ccChat("hello")
+	tests := []struct {
+		name     string
+		frame    []byte
+		danmakus []Danmaku
+		err      bool
+	}{
+		{name: "chat", frame: ccChat("hello", "world"), danmakus: []Danmaku{
+			{Kind: KIND_CHAT, Text: "hello", Name: "user", UID: "42"},
+			{Kind: KIND_CHAT, Text: "world", Name: "user", UID: "42"},
+		}},
+		{name: "sample", frame: sample, danmakus: []Danmaku{{Kind: KIND_CHAT, Text: "hi", Name: "u", UID: "12345"}}},
+		{name: "heartbeat", frame: heartbeat},
+		{name: "short", frame: chat[:6], err: true},
+		{name: "truncated", frame: chat[:len(chat)-1], err: true},
+	}
+	for _, tt := range tests {
+		res, err := (&NeteaseCC{}).decode(tt.frame)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		var danmakus []Danmaku
+		for _, message := range res {
+			danmaku := ccDanmaku(message)
+			danmakus = append(danmakus, Danmaku{Kind: danmaku.Kind, Text: danmaku.Text, Name: danmaku.Name, UID: danmaku.UID})
+		}
+		if !reflect.DeepEqual(danmakus, tt.danmakus) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, danmakus, tt.danmakus)
+		}
+	}
+}
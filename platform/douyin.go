@@ -0,0 +1,333 @@
+package platform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"live/util"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+const (
+	DouyinBaseUrl    = "https://live.douyin.com/"
+	DouyinRoomUrl    = "https://live.douyin.com/webcast/room/web/enter/?aid=6383&device_platform=web&enter_from=web_live&cookie_enabled=true&browser_language=zh-CN&browser_platform=Win32&browser_name=Chrome&browser_version=84.0.4147.105&web_rid=%s"
+	DouyinDanmakuUrl = "wss://webcast3-ws-web-lq.douyin.com/webcast/im/push/v2/?%s"
+	DouyinUserAgent  = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/84.0.4147.105 Safari/537.36"
+)
+
+// douyin room status, 2 means living
+const DOUYIN_STATUS_LIVING = 2
+
+// stream resolutions from high to low
+var DouyinQualities = []struct {
+	Key         string
+	Description string
+}{
+	{"FULL_HD1", "蓝光"},
+	{"HD1", "超清"},
+	{"SD1", "高清"},
+	{"SD2", "标清"},
+}
+
+const DOUYIN Type = 4
+
+var DouyinRoomUrlRe = regexp.MustCompile(`^live\.douyin\.com/(\d+)`)
+
+func init() {
+	Register(&Adapter{
+		Type:         DOUYIN,
+		Name:         "douyin",
+		Capabilities: Capabilities{Danmaku: true},
+		URL:          DouyinRoomUrlRe,
+		ShortHosts:   []string{"v.douyin.com"},
+		New:          GetDouyinRoom,
+	})
+}
+
+type Douyin struct {
+	*BaseRoom
+	RoomID  string
+	Quality uint
+	Status  int
+	Dan     *websocket.Conn
+	// room info from enter api
+	room gjson.Result
+	// internal room id used by danmaku, differs from web room id
+	realRoomID string
+	ttwid      string
+	// acks are written by heartbeat, websocket supports only one writer
+	ack chan []byte
+}
+
+// douyinTtwid gets the ttwid cookie, all douyin apis reject requests without it
+func douyinTtwid() (string, error) {
+	cookies, err := util.Cookies(DouyinBaseUrl, map[string]string{
+		"User-Agent": DouyinUserAgent,
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, cookie := range cookies {
+		if cookie.Name == "ttwid" {
+			return cookie.Value, nil
+		}
+	}
+	return "", errors.New("douyin ttwid not found")
+}
+
+func GetDouyinRoom(id string, quality uint, client *websocket.Conn) (Room, error) {
+	ttwid, err := douyinTtwid()
+	if err != nil {
+		return nil, err
+	}
+	res, err := util.Request("GET", fmt.Sprintf(DouyinRoomUrl, url.QueryEscape(id)), "", map[string]string{
+		"User-Agent": DouyinUserAgent,
+		"Cookie":     "ttwid=" + ttwid,
+		"Referer":    DouyinBaseUrl,
+	})
+	if err != nil {
+		return nil, err
+	}
+	data := gjson.ParseBytes(res)
+	if data.Get("status_code").Int() != 0 || !data.Get("data.user").Exists() {
+		return nil, errors.New(fmt.Sprintf("room %s not found", id))
+	}
+	room := data.Get("data.data.0")
+	status := 0
+	if room.Get("status").Int() == DOUYIN_STATUS_LIVING {
+		status = 1
+	}
+	if client == nil {
+		return &Douyin{
+			RoomID:  id,
+			Quality: quality,
+			Status:  status,
+			room:    room,
+		}, nil
+	}
+	return joinRoom(roomIndex(DOUYIN, id), func() Room {
+		room := &Douyin{
+			RoomID:     id,
+			realRoomID: room.Get("id_str").String(),
+			ttwid:      ttwid,
+		}
+		room.BaseRoom = newBaseRoom(DOUYIN, id, room)
+		return room
+	}, client), nil
+}
+
+func (d *Douyin) GetLiveInfo() (*Platform, error) {
+	if d.Status != 1 {
+		return &Platform{
+			Type:           DOUYIN,
+			RoomID:         d.RoomID,
+			Status:         0,
+			CurrentQuality: d.Quality,
+			Title:          d.room.Get("title").String(),
+		}, nil
+	}
+	// quality is the index of DouyinQualities plus one, 0 means the best one.
+	// links of the quality are the flv one then the hls one
+	var qualities []Quality
+	var links []Link
+	for i, quality := range DouyinQualities {
+		var current []Link
+		for _, path := range []string{"stream_url.flv_pull_url.", "stream_url.hls_pull_url_map."} {
+			if link := d.room.Get(path + quality.Key).String(); link != "" {
+				current = append(current, newLink(link, ""))
+			}
+		}
+		if len(current) == 0 {
+			continue
+		}
+		qualities = append(qualities, Quality{
+			Quality:     uint64(i + 1),
+			Description: quality.Description,
+		})
+		if links == nil || d.Quality == uint(i+1) {
+			links = current
+		}
+	}
+	link := ""
+	if len(links) > 0 {
+		link = links[0].URL
+	}
+	return &Platform{
+		Type:           DOUYIN,
+		RoomID:         d.RoomID,
+		Status:         uint(d.Status),
+		CurrentQuality: d.Quality,
+		Link:           link,
+		Links:          links,
+		Qualities:      qualities,
+		Title:          d.room.Get("title").String(),
+	}, nil
+}
+
+// danmaku data structure
+// every frame is a protobuf PushFrame, the payload of "msg" frames is a gzipped Response
+// PushFrame: 1 seqId, 2 logId, 5 headers, 6 payloadEncoding, 7 payloadType, 8 payload
+// Response:  1 messages, 2 cursor, 5 internalExt, 9 needAck
+// Message:   1 method, 2 payload
+// source: https://github.com/LyzenX/DouyinLiveRecorder/blob/main/dylr/core/dy_pb2.py
+func (d *Douyin) encode(payloadType string, logID uint64, payload []byte) []byte {
+	w := &pbWriter{}
+	w.Uint(2, logID)
+	w.String(7, payloadType)
+	w.Bytes(8, payload)
+	return w.Data()
+}
+
+func (d *Douyin) decode(raw []byte) ([]pbMessage, error) {
+	frame, err := pbUnmarshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	if frame.String(7) != "msg" {
+		return nil, nil
+	}
+	data, err := gunzip(DOUYIN, frame.Bytes(8))
+	if err != nil {
+		return nil, err
+	}
+	response, err := pbUnmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if response.Bool(9) {
+		select {
+		case d.ack <- d.encode("ack", frame.Uint(2), response.Bytes(5)):
+		default:
+		}
+	}
+	return response.Messages(1), nil
+}
+
+func (d *Douyin) heartBeat(ctx context.Context) error {
+	defer logger.Infof("heartbeat of room %s exited", d.RoomID)
+	data := d.encode("hb", 0, nil)
+	ticker := time.NewTicker(time.Second * 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := d.Dan.WriteMessage(websocket.BinaryMessage, data)
+			if err != nil {
+				return err
+			}
+		case ack := <-d.ack:
+			err := d.Dan.WriteMessage(websocket.BinaryMessage, ack)
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// douyinDanmaku converts chat, gift, like and member messages to danmaku
+// user: 1 id, 3 nickName
+func douyinDanmaku(message pbMessage) *Danmaku {
+	payload := message.Message(2)
+	var text string
+	var user pbMessage
+	var gift *Gift
+	kind := KIND_CHAT
+	switch message.String(1) {
+	case "WebcastChatMessage":
+		user = payload.Message(2)
+		text = payload.String(3)
+	case "WebcastGiftMessage":
+		user = payload.Message(7)
+		count := payload.Uint(6)
+		if count == 0 {
+			count = payload.Uint(5)
+		}
+		kind = KIND_GIFT
+		gift = &Gift{
+			ID:    fmt.Sprint(payload.Uint(2)),
+			Name:  payload.Message(15).String(16),
+			Count: int(count),
+		}
+		text = fmt.Sprintf("%s 送出 %s x%d", user.String(3), gift.Name, count)
+	case "WebcastLikeMessage":
+		user = payload.Message(5)
+		kind = KIND_LIKE
+		text = fmt.Sprintf("%s 点赞了 x%d", user.String(3), payload.Uint(2))
+	case "WebcastMemberMessage":
+		user = payload.Message(2)
+		kind = KIND_ENTRY
+		text = fmt.Sprintf("%s 来了", user.String(3))
+	default:
+		return nil
+	}
+	return &Danmaku{
+		Kind:      kind,
+		Text:      text,
+		Color:     "#ffffff",
+		Type:      DANMAKU_SCROLL,
+		UID:       fmt.Sprint(user.Uint(1)),
+		Name:      user.String(3),
+		Timestamp: nowMillis(),
+		Gift:      gift,
+	}
+}
+
+// handle converts messages of a frame to danmaku
+func (d *Douyin) handle(raw []byte) ([]*Danmaku, error) {
+	res, err := d.decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	var danmakus []*Danmaku
+	for _, message := range res {
+		if danmaku := douyinDanmaku(message); danmaku != nil {
+			danmakus = append(danmakus, danmaku)
+		}
+	}
+	return danmakus, nil
+}
+
+func (d *Douyin) dial() error {
+	params := url.Values{}
+	params.Set("app_name", "douyin_web")
+	params.Set("version_code", "180800")
+	params.Set("webcast_sdk_version", "1.3.0")
+	params.Set("update_version_code", "1.3.0")
+	params.Set("compress", "gzip")
+	params.Set("host", "https://live.douyin.com")
+	params.Set("aid", "6383")
+	params.Set("live_id", "1")
+	params.Set("did_rule", "3")
+	params.Set("endpoint", "live_pc")
+	params.Set("support_wrds", "1")
+	params.Set("im_path", "/webcast/im/fetch/")
+	params.Set("user_unique_id", fmt.Sprint(7000000000000000000+rand.Int63n(1000000000000000000)))
+	params.Set("device_platform", "web")
+	params.Set("identity", "audience")
+	params.Set("room_id", d.realRoomID)
+	params.Set("heartbeatDuration", "0")
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(DouyinDanmakuUrl, params.Encode()), http.Header{
+		"User-Agent": []string{DouyinUserAgent},
+		"Cookie":     []string{"ttwid=" + d.ttwid},
+	})
+	if err != nil {
+		return err
+	}
+	logger.Infof("connect to danmaku %s", d.RoomID)
+	d.Dan = conn
+	d.ack = make(chan []byte, 16)
+	// no authentication is needed after the handshake
+	return nil
+}
+
+func (d *Douyin) serve(ctx context.Context) error {
+	return serveConn(ctx, d.Dan, d.listen(d.Dan, d.handle), d.heartBeat)
+}
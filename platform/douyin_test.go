@@ -0,0 +1,173 @@
+package platform
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestDouyinLiveInfo(t *testing.T) {
+	room := gjson.Parse(`{"status":2,"title":"title","stream_url":{
+		"flv_pull_url":{"FULL_HD1":"https://pull-flv-l1.douyincdn.com/stage/stream_or4.flv","SD1":"https://pull-flv-l1.douyincdn.com/stage/stream_sd.flv"},
+		"hls_pull_url_map":{"FULL_HD1":"https://pull-hls-l1.douyincdn.com/stage/stream_or4.m3u8","HD1":"https://pull-hls-l1.douyincdn.com/stage/stream_hd.m3u8"}}}`)
+	qualities := []Quality{
+		{Quality: 1, Description: "蓝光"},
+		{Quality: 2, Description: "超清"},
+		{Quality: 3, Description: "高清"},
+	}
+	tests := []struct {
+		quality uint
+		links   []string
+	}{
+		{quality: 0, links: []string{"https://pull-flv-l1.douyincdn.com/stage/stream_or4.flv", "https://pull-hls-l1.douyincdn.com/stage/stream_or4.m3u8"}},
+		{quality: 1, links: []string{"https://pull-flv-l1.douyincdn.com/stage/stream_or4.flv", "https://pull-hls-l1.douyincdn.com/stage/stream_or4.m3u8"}},
+		// only hls or flv
+		{quality: 2, links: []string{"https://pull-hls-l1.douyincdn.com/stage/stream_hd.m3u8"}},
+		{quality: 3, links: []string{"https://pull-flv-l1.douyincdn.com/stage/stream_sd.flv"}},
+		// missing quality is the best one
+		{quality: 4, links: []string{"https://pull-flv-l1.douyincdn.com/stage/stream_or4.flv", "https://pull-hls-l1.douyincdn.com/stage/stream_or4.m3u8"}},
+	}
+	for _, tt := range tests {
+		info, err := (&Douyin{RoomID: "1", Quality: tt.quality, Status: 1, room: room}).GetLiveInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var links []string
+		for _, link := range info.Links {
+			if link.Host != "pull-flv-l1.douyincdn.com" && link.Host != "pull-hls-l1.douyincdn.com" {
+				t.Errorf("quality %d: host of %+v", tt.quality, link)
+			}
+			links = append(links, link.URL)
+		}
+		if !reflect.DeepEqual(links, tt.links) || info.Link != tt.links[0] {
+			t.Errorf("quality %d: got %s %q, want %q", tt.quality, info.Link, links, tt.links)
+		}
+		if !reflect.DeepEqual(info.Qualities, qualities) {
+			t.Errorf("quality %d: qualities %+v", tt.quality, info.Qualities)
+		}
+	}
+	info, err := (&Douyin{RoomID: "1", room: gjson.Parse(`{"status":4,"title":"title"}`)}).GetLiveInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Status != 0 || info.Link != "" || len(info.Links) != 0 || info.Title != "title" {
+		t.Errorf("offline room got %+v", info)
+	}
+}
+
+// douyinUser writes a user of id and nickname
+func douyinUser(id uint64, name string) func(w *pbWriter) {
+	return func(w *pbWriter) {
+		w.Uint(1, id)
+		w.String(3, name)
+	}
+}
+
+// douyinMessage makes a Message of method with its payload
+func douyinMessage(method string, payload func(w *pbWriter)) func(w *pbWriter) {
+	return func(w *pbWriter) {
+		w.String(1, method)
+		w.Message(2, payload)
+	}
+}
+
+// douyinPush makes a msg PushFrame of logID with a gzipped Response of messages
+func douyinPush(logID uint64, needAck bool, messages ...func(w *pbWriter)) []byte {
+	response := &pbWriter{}
+	for _, message := range messages {
+		response.Message(1, message)
+	}
+	response.String(5, "internal_ext")
+	response.Bool(9, needAck)
+	return (&Douyin{}).encode("msg", logID, gzipBody(response.Data()))
+}
+
+func TestDouyinDecode(t *testing.T) {
+	chat := douyinMessage("WebcastChatMessage", func(w *pbWriter) {
+		w.Message(2, douyinUser(42, "user"))
+		w.String(3, "hello")
+	})
+	gift := douyinMessage("WebcastGiftMessage", func(w *pbWriter) {
+		w.Uint(2, 463)
+		w.Uint(5, 1)
+		w.Uint(6, 3)
+		w.Message(7, douyinUser(43, "user2"))
+		w.Message(15, func(w *pbWriter) {
+			w.String(16, "小心心")
+		})
+	})
+	member := douyinMessage("WebcastMemberMessage", func(w *pbWriter) {
+		w.Message(2, douyinUser(44, "user3"))
+	})
+	other := douyinMessage("WebcastRoomUserSeqMessage", func(w *pbWriter) {
+		w.Uint(3, 100)
+	})
+	broken := (&Douyin{}).encode("msg", 1, []byte("not gzip"))
+	tests := []struct {
+		name     string
+		frame    []byte
+		danmakus []Danmaku
+		ack      bool
+		err      bool
+	}{
+		{name: "chat and gift", frame: douyinPush(7, false, chat, gift, other), danmakus: []Danmaku{
+			{Kind: KIND_CHAT, Text: "hello", UID: "42", Name: "user"},
+			{Kind: KIND_GIFT, Text: "user2 送出 小心心 x3", UID: "43", Name: "user2", Gift: &Gift{ID: "463", Name: "小心心", Count: 3}},
+		}},
+		{name: "need ack", frame: douyinPush(7, true, member), ack: true, danmakus: []Danmaku{
+			{Kind: KIND_ENTRY, Text: "user3 来了", UID: "44", Name: "user3"},
+		}},
+		{name: "heartbeat", frame: (&Douyin{}).encode("hb", 0, nil)},
+		{name: "broken gzip", frame: broken, err: true},
+		{name: "truncated", frame: douyinPush(7, false, chat)[:10], err: true},
+	}
+	for _, tt := range tests {
+		d := &Douyin{ack: make(chan []byte, 1)}
+		res, err := d.decode(tt.frame)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		var danmakus []Danmaku
+		for _, message := range res {
+			if danmaku := douyinDanmaku(message); danmaku != nil {
+				danmakus = append(danmakus, Danmaku{Kind: danmaku.Kind, Text: danmaku.Text, UID: danmaku.UID, Name: danmaku.Name, Gift: danmaku.Gift})
+			}
+		}
+		if !reflect.DeepEqual(danmakus, tt.danmakus) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, danmakus, tt.danmakus)
+		}
+		select {
+		case ack := <-d.ack:
+			frame, err := pbUnmarshal(ack)
+			if !tt.ack || err != nil || frame.String(7) != "ack" || frame.Uint(2) != 7 || frame.String(8) != "internal_ext" {
+				t.Errorf("%s: got ack %q", tt.name, ack)
+			}
+		default:
+			if tt.ack {
+				t.Errorf("%s: no ack", tt.name)
+			}
+		}
+	}
+}
+
+func TestDouyinLike(t *testing.T) {
+	w := &pbWriter{}
+	w.String(1, "WebcastLikeMessage")
+	w.Message(2, func(w *pbWriter) {
+		w.Uint(2, 3)
+		w.Message(5, func(w *pbWriter) {
+			w.Uint(1, 42)
+			w.String(3, "user")
+		})
+	})
+	message, err := pbUnmarshal(w.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	danmaku := douyinDanmaku(message)
+	if danmaku.Kind != KIND_LIKE || danmaku.UID != "42" || danmaku.Text != "user 点赞了 x3" {
+		t.Errorf("got %+v", danmaku)
+	}
+}
@@ -1,8 +1,12 @@
 package platform
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
@@ -11,180 +15,386 @@ import (
 	"github.com/tidwall/gjson"
 	"io/ioutil"
 	"live/util"
+	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	DouyuBaseUrl      = "https://www.douyu.com/%d"
-	DouyuRoomUrl      = "https://www.douyu.com/lapi/live/getH5Play/%d"
-	DouyuDID          = "'10000000000000000000000000001501'"
-	DouyuDanmakuUrl   = "wss://danmuproxy.douyu.com:8501/"
-	DouyuLoginMsg     = "type@=loginreq/roomid@=%d/"
-	DouyuJoinGroupMsg = "type@=joingroup/rid@=%d/gid@=-9999/"
+	DouyuBaseUrl    = "https://www.douyu.com/%s"
+	DouyuRoomUrl    = "https://www.douyu.com/lapi/live/getH5Play/%d"
+	DouyuDID        = "'10000000000000000000000000001501'"
+	DouyuDanmakuUrl = "wss://danmuproxy.douyu.com:8501/"
+	DouyuInfoUrl    = "https://www.douyu.com/betard/%d"
+	// the group has all danmaku
+	DouyuGroupAll = -9999
+	// online count is polled since danmaku doesn't have it
+	DouyuOnlineInterval = time.Minute
 )
 
+const (
+	// length of the two length fields and the rest of header
+	DOUYU_LENGTH_SIZE = 4
+	DOUYU_HEADER_SIZE = 8
+	// packets larger than it are treated as malformed
+	DOUYU_MAX_PACKET_LENGTH = 1 << 20
+)
+
+// gift list is a var so that tests can replace it with a local one
+var DouyuGiftUrl = "https://gift.douyucdn.cn/api/gift/v3/web/list?rid=%d"
+
 var (
-	DouyuRoomIDRe      = regexp.MustCompile(`\$ROOM\.room_id\s*=\s*(\d+)`)
-	DouyuRoomStatusRe  = regexp.MustCompile(`\$ROOM\.show_status\s*=\s*(\d+)`)
-	DouyuJsRe          = regexp.MustCompile(`<script type="text/javascript">(\s*var[\s\S]*?)</script>`)
-	DouyuDanmakuTypeRe = regexp.MustCompile(`type@=(\w+)/?`)
-	DouyuDanmakuTxtRe  = regexp.MustCompile(`txt@=([\s\S]+?)/`)
+	DouyuRoomIDRe     = regexp.MustCompile(`\$ROOM\.room_id\s*=\s*(\d+)`)
+	DouyuRoomStatusRe = regexp.MustCompile(`\$ROOM\.show_status\s*=\s*(\d+)`)
+	DouyuJsRe         = regexp.MustCompile(`<script type="text/javascript">(\s*var[\s\S]*?)</script>`)
+	// version of sign in the script of ub98484234
+	DouyuSignVersionRe = regexp.MustCompile(`vdwdae325w_64we\s*=\s*"(\d+)"`)
 )
 
+// colors of danmaku, index is the col field
+var DouyuColors = []string{"#ffffff", "#ff0000", "#1e87f0", "#7ac84b", "#ff7f00", "#9b39f4", "#ff69b4"}
+
+// stt messages sent to douyu
+type douyuLoginReq struct {
+	Type   string `stt:"type"`
+	RoomID uint   `stt:"roomid"`
+}
+
+type douyuJoinGroup struct {
+	Type string `stt:"type"`
+	RID  uint   `stt:"rid"`
+	GID  int    `stt:"gid"`
+}
+
+type douyuHeartbeat struct {
+	Type string `stt:"type"`
+}
+
+// douyuMessage has fields of received messages used here, other fields are in raw
+type douyuMessage struct {
+	Type string `stt:"type"`
+	// sender of chatmsg, dgb and uenter
+	UID   string `stt:"uid"`
+	Nn    string `stt:"nn"`
+	Level int    `stt:"level"`
+	Rg    int    `stt:"rg"`
+	Bnn   string `stt:"bnn"`
+	Bl    int    `stt:"bl"`
+	// chatmsg
+	Txt string `stt:"txt"`
+	Col int    `stt:"col"`
+	Cst int64  `stt:"cst"`
+	// dgb
+	Gfid  string `stt:"gfid"`
+	Gfcnt int    `stt:"gfcnt"`
+	// rss
+	Ss int `stt:"ss"`
+	// noble_num_info
+	Sum int64 `stt:"sum"`
+	raw map[string]interface{}
+}
+
+const DOUYU Type = 1
+
+var DouyuRoomUrlRe = regexp.MustCompile(`^(?:www\.|m\.)?douyu\.com/(?:.*[?&]rid=(\d+)|(?:beta/)?(\w+))`)
+
+// pages matched by room url pattern
+var DouyuReservedPaths = []string{"topic", "directory", "member", "search", "special", "g_*"}
+
+func init() {
+	Register(&Adapter{
+		Type:         DOUYU,
+		Name:         "douyu",
+		Capabilities: Capabilities{Danmaku: true, Reconnect: true, Stats: true, Raw: true},
+		URL:          DouyuRoomUrlRe,
+		Reserved:     DouyuReservedPaths,
+		New:          GetDouyuRoom,
+	})
+}
+
 type Douyu struct {
-	ctx     context.Context
-	cancel  context.CancelFunc
-	Closed  bool
+	*BaseRoom
 	RoomID  uint
 	Quality uint
 	Status  int
 	Dan     *websocket.Conn
-	Clients map[*websocket.Conn]bool
+	// room of betard, only kept for live info
+	room gjson.Result
+	// gift names by id, dgb messages only have gift id
+	gifts map[string]string
+	// packets split over messages, a new one is made for every connection
+	reader *douyuReader
 }
 
-func (d *Douyu) GetClients() map[*websocket.Conn]bool {
-	return d.Clients
-}
-
-func (d *Douyu) IsClosed() bool {
-	return d.Closed
-}
-
-func GetDouyuRoom(roomID, quality uint, client *websocket.Conn) (Room, error) {
+func GetDouyuRoom(id string, quality uint, client *websocket.Conn) (Room, error) {
 	// get real room id
-	html, err := util.Request("GET", fmt.Sprintf(DouyuBaseUrl, roomID), "", nil)
-	if err != nil {
-		return nil, err
-	}
-	r := DouyuRoomIDRe.FindSubmatch(html)
-	if len(r) == 0 {
-		return nil, errors.New(fmt.Sprintf("room %d not found", roomID))
-	}
-	_roomID, err := strconv.Atoi(string(r[1]))
+	html, err := util.Request("GET", fmt.Sprintf(DouyuBaseUrl, id), "", nil)
 	if err != nil {
 		return nil, err
 	}
-	roomID = uint(_roomID)
-
-	// get room status
-	status, err := strconv.Atoi(string(DouyuRoomStatusRe.FindSubmatch(html)[1]))
+	roomID, status, err := douyuRoom(id, html)
 	if err != nil {
 		return nil, err
 	}
 	if client == nil {
+		res, err := util.Request("GET", fmt.Sprintf(DouyuInfoUrl, roomID), "", nil)
+		if err != nil {
+			return nil, err
+		}
 		return &Douyu{
 			RoomID:  roomID,
 			Quality: quality,
 			Status:  status,
+			room:    gjson.GetBytes(res, "room"),
 		}, nil
 	}
-	index := fmt.Sprintf("%d:%d", DOUYU, roomID)
-	if rooms[index] == nil {
-		rooms[index] = &Douyu{
-			Closed:  false,
-			Clients: make(map[*websocket.Conn]bool),
-			RoomID:  roomID,
+	return joinRoom(roomIndex(DOUYU, fmt.Sprint(roomID)), func() Room {
+		room := &Douyu{
+			RoomID: roomID,
 		}
+		room.BaseRoom = newBaseRoom(DOUYU, fmt.Sprint(roomID), room)
+		return room
+	}, client), nil
+}
+
+// douyuRoom finds the real room id and the status in room page
+func douyuRoom(id string, html []byte) (uint, int, error) {
+	r := DouyuRoomIDRe.FindSubmatch(html)
+	if len(r) == 0 {
+		return 0, 0, errors.New(fmt.Sprintf("room %s not found", id))
 	}
-	AddClient(rooms[index], client)
-	return rooms[index], nil
+	roomID, err := strconv.Atoi(string(r[1]))
+	if err != nil {
+		return 0, 0, err
+	}
+	r = DouyuRoomStatusRe.FindSubmatch(html)
+	if len(r) == 0 {
+		return 0, 0, errors.New(fmt.Sprintf("status of room %s not found", id))
+	}
+	status, err := strconv.Atoi(string(r[1]))
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint(roomID), status, nil
 }
 
 func (d *Douyu) GetLiveInfo() (*Platform, error) {
+	info := d.roomInfo()
+	info.CurrentQuality = d.Quality
 	if d.Status != 1 {
-		return &Platform{
-			Type:           DOUYU,
-			RoomID:         d.RoomID,
-			Status:         0,
-			CurrentQuality: d.Quality,
-		}, nil
+		return info, nil
 	}
-	html, err := util.Request("GET", fmt.Sprintf(DouyuBaseUrl, d.RoomID), "", nil)
+	html, err := util.Request("GET", fmt.Sprintf(DouyuBaseUrl, fmt.Sprint(d.RoomID)), "", nil)
 	if err != nil {
 		return nil, err
 	}
+	params, data, err := douyuPlay(html, d.RoomID, time.Now().Unix(), func(params string) (gjson.Result, error) {
+		return d.playInfo(params, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("params %s", params)
+	var qualities []Quality
+	data.Get("data.multirates").ForEach(func(key, value gjson.Result) bool {
+		qualities = append(qualities, Quality{
+			Quality:     value.Get("rate").Uint(),
+			Description: value.Get("name").String(),
+		})
+		return true
+	})
+	info.Status = uint(d.Status)
+	info.Link = douyuLink(data)
+	info.Links = d.links(params, data)
+	info.Qualities = qualities
+	return info, nil
+}
+
+// douyuPlayError returns the error in response of getH5Play
+func douyuPlayError(data gjson.Result) error {
+	if code := data.Get("error").Int(); code != 0 {
+		return errors.New(fmt.Sprintf("getH5Play error %d: %s", code, data.Get("msg").String()))
+	}
+	return nil
+}
+
+// versions of sign script whose native sign was rejected by douyu, pages of them are
+// signed by the js vm only so that a request doesn't pay for two getH5Play
+var douyuRejectedVersions sync.Map
+
+// douyuPlay signs params and requests stream info by play, the native sign is tried first
+// unless it's rejected before for the sign version of page, then the script of page is run
+func douyuPlay(html []byte, roomID uint, tt int64, play func(params string) (gjson.Result, error)) (string, gjson.Result, error) {
+	version := douyuSignVersion(html)
+	if _, rejected := douyuRejectedVersions.Load(version); !rejected {
+		params, err := douyuSign(html, roomID, tt)
+		if err == nil {
+			var data gjson.Result
+			data, err = play(params)
+			if err != nil {
+				return "", gjson.Result{}, err
+			}
+			err = douyuPlayError(data)
+			if err == nil {
+				return params, data, nil
+			}
+		}
+		logger.Errorf("sign version %s of room %d rejected, fallback to js: %v", version, roomID, err)
+		douyuRejectedVersions.Store(version, true)
+	}
+	params, err := douyuSignJS(html, roomID, tt)
+	if err != nil {
+		return "", gjson.Result{}, err
+	}
+	data, err := play(params)
+	if err != nil {
+		return "", gjson.Result{}, err
+	}
+	return params, data, douyuPlayError(data)
+}
+
+// douyuSignVersion returns the version of sign script in page, it's empty if not found
+func douyuSignVersion(html []byte) string {
+	r := DouyuSignVersionRe.FindSubmatch(html)
+	if len(r) == 0 {
+		return ""
+	}
+	return string(r[1])
+}
+
+// douyuSign returns signed params of getH5Play without the js vm, it assumes ub98484234
+// of room page signs md5(rid + did + tt + v) where v is the version in page. douyu may
+// change the script at any time, douyuPlay stops using it for versions rejected
+func douyuSign(html []byte, roomID uint, tt int64) (string, error) {
+	v := douyuSignVersion(html)
+	if v == "" {
+		return "", errors.New("version of sign not found")
+	}
+	did := strings.Trim(DouyuDID, "'")
+	sum := md5.Sum([]byte(fmt.Sprintf("%d%s%d%s", roomID, did, tt, v)))
+	return fmt.Sprintf("v=%s&did=%s&tt=%d&sign=%s", v, did, tt, hex.EncodeToString(sum[:])), nil
+}
+
+// douyuSignJS runs ub98484234 of room page in js vm, it's slow but follows changes of douyu
+func douyuSignJS(html []byte, roomID uint, tt int64) (string, error) {
 	matches := DouyuJsRe.FindAllSubmatch(html, -1)
+	if len(matches) == 0 {
+		return "", errors.New("script of sign not found")
+	}
 	code := matches[len(matches)-1][1]
 	js, err := pkger.Open("/util/CryptoJS.js")
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	defer js.Close()
 	cryptoJS, err := ioutil.ReadAll(js)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	// js vm
 	vm := otto.New()
 	// use js vm to get params
 	v, err := vm.Run(append(append(cryptoJS, code...),
-		[]byte(fmt.Sprintf("ub98484234(%d,%s,%d)", d.RoomID, DouyuDID, time.Now().Unix()))...))
+		[]byte(fmt.Sprintf("ub98484234(%d,%s,%d)", roomID, DouyuDID, tt))...))
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	return v.String(), nil
+}
+
+// playInfo requests stream of cdn with signed params, cdn is chosen by douyu if empty
+func (d *Douyu) playInfo(params, cdn string) (gjson.Result, error) {
+	body := fmt.Sprintf("%s&rate=%d", params, d.Quality)
+	if cdn != "" {
+		body += "&cdn=" + url.QueryEscape(cdn)
 	}
-	logger.Debugf("params %s", v.String())
 	res, err := util.Request(
 		"POST",
 		fmt.Sprintf(DouyuRoomUrl, d.RoomID),
-		fmt.Sprintf("%s&rate=%d", v.String(), d.Quality),
+		body,
 		map[string]string{
 			"Content-type": "application/x-www-form-urlencoded",
 		})
 	if err != nil {
-		return nil, err
+		return gjson.Result{}, err
 	}
 	logger.Debugf(string(res))
-	data := gjson.ParseBytes(res)
-	var qualities []Quality
-	data.Get("data.multirates").ForEach(func(key, value gjson.Result) bool {
-		qualities = append(qualities, Quality{
-			Quality:     value.Get("rate").Uint(),
-			Description: value.Get("name").String(),
-		})
-		return true
-	})
-	return &Platform{
-		Type:           DOUYU,
-		RoomID:         d.RoomID,
-		Status:         uint(d.Status),
-		CurrentQuality: d.Quality,
-		Link:           data.Get("data.rtmp_url").String() + "/" + data.Get("data.rtmp_live").String(),
-		Qualities:      qualities,
-	}, nil
-}
-
-func (d *Douyu) Send(danmaku *Danmaku) {
-	logger.Infof("danmaku %+v", danmaku)
-	if len(d.Clients) == 0 {
-		d.Close()
-		return
-	}
-	for client := range d.Clients {
-		err := client.WriteJSON(danmaku)
-		if err != nil {
-			RemoveClient(d, client)
+	return gjson.ParseBytes(res), nil
+}
+
+func douyuLink(data gjson.Result) string {
+	return data.Get("data.rtmp_url").String() + "/" + data.Get("data.rtmp_live").String()
+}
+
+// links returns lines of all cdns, a line is requested for every cdn other than the one of
+// data at the same time, cdns failed are skipped
+func (d *Douyu) links(params string, data gjson.Result) []Link {
+	current := data.Get("data.rtmp_cdn").String()
+	cdns := data.Get("data.cdnsWithName").Array()
+	links := make([]Link, len(cdns))
+	var wg sync.WaitGroup
+	for i, cdn := range cdns {
+		name := cdn.Get("name").String()
+		cdn := cdn.Get("cdn").String()
+		if cdn == current {
+			links[i] = newLink(douyuLink(data), name)
 			continue
 		}
+		wg.Add(1)
+		go func(link *Link) {
+			defer wg.Done()
+			data, err := d.playInfo(params, cdn)
+			if err != nil || data.Get("error").Int() != 0 {
+				logger.Errorf("request cdn %s of room %d failed: %v", cdn, d.RoomID, err)
+				return
+			}
+			*link = newLink(douyuLink(data), name)
+		}(&links[i])
 	}
+	wg.Wait()
+	result := make([]Link, 0, len(links))
+	for _, link := range links {
+		if link.URL != "" {
+			result = append(result, link)
+		}
+	}
+	if len(result) == 0 {
+		result = append(result, newLink(douyuLink(data), current))
+	}
+	return result
 }
 
-func (d *Douyu) Close() {
-	if d.Closed {
-		return
+// roomInfo returns live info with room metadata of betard, it's offline until status is set
+func (d *Douyu) roomInfo() *Platform {
+	var tags []string
+	d.room.Get("room_biz_all.tags").ForEach(func(key, value gjson.Result) bool {
+		if name := value.Get("name").String(); name != "" {
+			tags = append(tags, name)
+		}
+		return true
+	})
+	startTime := int64(0)
+	if d.Status == 1 {
+		startTime = d.room.Get("show_time").Int()
 	}
-	d.Closed = true
-	// stop heartbeat and listener, note listener will not exit until this func is done
-	d.cancel()
-	// close danmaku websocket (douyu)
-	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "close")
-	_ = d.Dan.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second*5))
-	for client := range d.Clients {
-		_ = client.Close()
+	return &Platform{
+		Type:   DOUYU,
+		RoomID: fmt.Sprint(d.RoomID),
+		Title:  d.room.Get("room_name").String(),
+		Cover:  d.room.Get("room_pic").String(),
+		Streamer: &Streamer{
+			UID:    d.room.Get("owner_uid").String(),
+			Name:   d.room.Get("owner_name").String(),
+			Avatar: d.room.Get("avatar.big").String(),
+		},
+		Area:      d.room.Get("second_lvl_name").String(),
+		StartTime: startTime,
+		Online:    douyuOnline(d.room),
+		Tags:      tags,
 	}
-	delete(rooms, fmt.Sprintf("%d:%d", DOUYU, d.RoomID))
-	logger.Infof("room %d closed, rooms %+v", d.RoomID, rooms)
 }
 
 // danmaku data structure
@@ -198,114 +408,277 @@ func (d *Douyu) encode(data []byte) []byte {
 	return append(append(header, data...), 0x00)
 }
 
-func (d *Douyu) decode(raw []byte) ([]string, error) {
+// douyuReader buffers websocket messages until packets in them are complete
+type douyuReader struct {
+	buf []byte
+}
+
+func (r *douyuReader) Write(data []byte) {
+	r.buf = append(r.buf, data...)
+}
+
+// Next returns body of the next packet without the ending 0, ok is false if more data are needed
+func (r *douyuReader) Next() (body []byte, ok bool, err error) {
+	if len(r.buf) < DOUYU_LENGTH_SIZE+DOUYU_HEADER_SIZE {
+		return nil, false, nil
+	}
+	length := binary.LittleEndian.Uint32(r.buf[0:])
+	if length != binary.LittleEndian.Uint32(r.buf[4:]) {
+		return nil, false, &FrameError{DOUYU, fmt.Sprintf("packet length %d mismatches %d",
+			length, binary.LittleEndian.Uint32(r.buf[4:]))}
+	}
+	if length < DOUYU_HEADER_SIZE || length > DOUYU_MAX_PACKET_LENGTH {
+		return nil, false, &FrameError{DOUYU, fmt.Sprintf("invalid packet length %d", length)}
+	}
+	total := int(length) + DOUYU_LENGTH_SIZE
+	if len(r.buf) < total {
+		return nil, false, nil
+	}
+	body = r.buf[DOUYU_LENGTH_SIZE+DOUYU_HEADER_SIZE : total]
+	r.buf = r.buf[total:]
+	if len(r.buf) == 0 {
+		r.buf = nil
+	}
+	return bytes.TrimRight(body, "\x00"), true, nil
+}
+
+// decode reads all complete packets of r
+func (d *Douyu) decode(r *douyuReader) ([]string, error) {
 	var res []string
-	for offset, length := 0, 0; offset < len(raw); offset += length + 4 {
-		length = int(binary.LittleEndian.Uint32(raw[offset:]))
-		res = append(res, string(raw[offset+12:offset+length+4]))
+	for {
+		body, ok, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return res, nil
+		}
+		res = append(res, string(body))
 	}
-	return res, nil
 }
 
 func (d *Douyu) authenticate() error {
 	// login req
-	err := d.Dan.WriteMessage(websocket.BinaryMessage,
-		d.encode([]byte(fmt.Sprintf(DouyuLoginMsg, d.RoomID))))
+	login, err := sttMarshal(douyuLoginReq{Type: "loginreq", RoomID: d.RoomID})
 	if err != nil {
 		return err
 	}
-	// join group req, the -9999 group has all danmaku
-	err = d.Dan.WriteMessage(websocket.BinaryMessage,
-		d.encode([]byte(fmt.Sprintf(DouyuJoinGroupMsg, d.RoomID))))
+	err = d.Dan.WriteMessage(websocket.BinaryMessage, d.encode(login))
 	if err != nil {
 		return err
 	}
-	return nil
+	// join group req
+	join, err := sttMarshal(douyuJoinGroup{Type: "joingroup", RID: d.RoomID, GID: DouyuGroupAll})
+	if err != nil {
+		return err
+	}
+	return d.Dan.WriteMessage(websocket.BinaryMessage, d.encode(join))
 }
 
-func (d *Douyu) heartBeat() {
+func (d *Douyu) heartBeat(ctx context.Context) error {
 	defer logger.Infof("heartbeat of room %d exited", d.RoomID)
-	data := d.encode([]byte("type@=mrkl/"))
+	heartbeat, _ := sttMarshal(douyuHeartbeat{Type: "mrkl"})
+	data := d.encode(heartbeat)
 	ticker := time.NewTicker(time.Second * 45)
 	defer ticker.Stop()
-	for true {
+	for {
 		select {
 		case <-ticker.C:
 			err := d.Dan.WriteMessage(websocket.BinaryMessage, data)
 			if err != nil {
-				logger.Error(err)
-				d.Close()
-				return
+				return err
 			}
-		case <-d.ctx.Done():
-			return
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// douyuParse decodes a stt message, raw keeps all fields
+func douyuParse(dan string) (*douyuMessage, error) {
+	message := &douyuMessage{}
+	err := sttUnmarshal([]byte(dan), message)
+	if err != nil {
+		return nil, err
+	}
+	err = sttUnmarshal([]byte(dan), &message.raw)
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// douyuDanmaku converts chatmsg, dgb (gift), uenter (entry) and rss (status) to danmaku, col is the
+// index of DouyuColors, bnn and bl are the medal, rg 4 means room admin and cst is the send time
+func douyuDanmaku(message *douyuMessage, gifts map[string]string) *Danmaku {
+	color := "#ffffff"
+	if message.Col > 0 && message.Col < len(DouyuColors) {
+		color = DouyuColors[message.Col]
+	}
+	timestamp := message.Cst
+	if timestamp == 0 {
+		timestamp = nowMillis()
+	}
+	raw, _ := json.Marshal(message.raw)
+	danmaku := &Danmaku{
+		Color:     color,
+		Type:      DANMAKU_SCROLL,
+		UID:       message.UID,
+		Name:      message.Nn,
+		Timestamp: timestamp,
+		Level:     message.Level,
+		Admin:     message.Rg == 4,
+		Raw:       raw,
+	}
+	switch message.Type {
+	case "chatmsg":
+		danmaku.Kind = KIND_CHAT
+		danmaku.Text = message.Txt
+	case "dgb":
+		// gfcnt is the count of this message, hits is the combo
+		count := message.Gfcnt
+		if count == 0 {
+			count = 1
+		}
+		danmaku.Kind = KIND_GIFT
+		danmaku.Gift = &Gift{
+			ID:    message.Gfid,
+			Name:  gifts[message.Gfid],
+			Count: count,
 		}
+		danmaku.Text = fmt.Sprintf("%s 送出 %s x%d", danmaku.Name, danmaku.Gift.Name, count)
+	case "uenter":
+		danmaku.Kind = KIND_ENTRY
+		danmaku.Text = fmt.Sprintf("%s 进入直播间", danmaku.Name)
+	case "rss":
+		// ss is 1 when live starts and 0 when it ends
+		danmaku.Kind = KIND_STATUS
+		if message.Ss == 1 {
+			danmaku.Text = "直播开始"
+			danmaku.Status = &LiveStatus{Event: STATUS_LIVE}
+		} else {
+			danmaku.Text = "直播结束"
+			danmaku.Status = &LiveStatus{Event: STATUS_OFFLINE}
+		}
+	default:
+		return nil
 	}
+	if message.Bnn != "" {
+		danmaku.Medal = &Medal{
+			Name:  message.Bnn,
+			Level: message.Bl,
+		}
+	}
+	return danmaku
 }
 
-func (d *Douyu) listener() {
-	defer logger.Infof("listener of room %d exited", d.RoomID)
-	var data []byte
+// giftNames gets names of gifts in the room, including the room's own gifts
+func (d *Douyu) giftNames() map[string]string {
+	gifts := map[string]string{}
+	res, err := util.Request("GET", fmt.Sprintf(DouyuGiftUrl, d.RoomID), "", nil)
+	if err != nil {
+		logger.Error(err)
+		return gifts
+	}
+	gjson.GetBytes(res, "data.giftList").ForEach(func(key, value gjson.Result) bool {
+		gifts[value.Get("id").String()] = value.Get("name").String()
+		return true
+	})
+	return gifts
+}
+
+// douyuOnline returns online count of betard room, douyu shows hot as online count
+func douyuOnline(room gjson.Result) int64 {
+	return room.Get("room_biz_all.hot").Int()
+}
+
+// pollOnline updates online stats from betard, danmaku of douyu has no viewer count
+// but only the count of nobles
+func (d *Douyu) pollOnline(ctx context.Context) {
+	defer logger.Infof("online poller of room %d exited", d.RoomID)
+	ticker := time.NewTicker(DouyuOnlineInterval)
+	defer ticker.Stop()
 	for {
+		res, err := util.Request("GET", fmt.Sprintf(DouyuInfoUrl, d.RoomID), "", nil)
+		if err != nil {
+			logger.Errorf("get online of room %d failed: %v", d.RoomID, err)
+		} else if room := gjson.GetBytes(res, "room"); room.Exists() {
+			d.stats.Update(func(stats *Stats) {
+				stats.Online = douyuOnline(room)
+			})
+			d.Send(&Danmaku{
+				Kind:      KIND_STATS,
+				Color:     "#ffffff",
+				Type:      DANMAKU_SCROLL,
+				Timestamp: nowMillis(),
+				Stats:     d.GetStats(),
+			})
+		}
 		select {
-		case <-d.ctx.Done():
+		case <-ticker.C:
+		case <-ctx.Done():
 			return
-		default:
-			_, raw, err := d.Dan.ReadMessage()
-			if d.Closed {
-				return
-			}
-			if err != nil {
-				logger.Error(err)
-				d.Close()
-				return
-			}
-			data = append(data, raw...)
-			if raw[len(raw)-1] != 0x0 {
-				logger.Debug("half")
-				break
-			}
-			res, err := d.decode(data)
-			if err != nil {
-				logger.Error(err)
-				d.Close()
-				return
-			}
-			data = []byte{}
-			logger.Debugf("room id %d clients %+v", d.RoomID, d.Clients)
-			for _, dan := range res {
-				danmakuType := DouyuDanmakuTypeRe.FindStringSubmatch(dan)[1]
-				if danmakuType == "chatmsg" {
-					d.Send(&Danmaku{
-						Text:  DouyuDanmakuTxtRe.FindStringSubmatch(dan)[1],
-						Color: "#fff",
-						Type:  0,
-					})
-				}
-			}
 		}
 	}
 }
 
-func (d *Douyu) Connect() {
-	if d.Dan != nil {
-		return
+// updateStats keeps the latest stats, it returns stats danmaku on noble_num_info
+// which is sent about every minute
+func (d *Douyu) updateStats(message *douyuMessage) *Danmaku {
+	if message.Type != "noble_num_info" {
+		return nil
+	}
+	d.stats.Update(func(stats *Stats) {
+		stats.Nobles = message.Sum
+	})
+	return &Danmaku{
+		Kind:      KIND_STATS,
+		Color:     "#ffffff",
+		Type:      DANMAKU_SCROLL,
+		Timestamp: nowMillis(),
+		Stats:     d.GetStats(),
+	}
+}
+
+// handle converts messages of a frame to danmaku, invalid messages are skipped
+func (d *Douyu) handle(raw []byte) ([]*Danmaku, error) {
+	d.reader.Write(raw)
+	res, err := d.decode(d.reader)
+	if err != nil {
+		return nil, err
+	}
+	var danmakus []*Danmaku
+	for _, dan := range res {
+		message, err := douyuParse(dan)
+		if err != nil {
+			logger.Errorf("invalid message %q: %s", dan, err)
+			continue
+		}
+		if danmaku := douyuDanmaku(message, d.gifts); danmaku != nil {
+			danmakus = append(danmakus, danmaku)
+		} else if stats := d.updateStats(message); stats != nil {
+			danmakus = append(danmakus, stats)
+		}
 	}
+	return danmakus, nil
+}
+
+func (d *Douyu) dial() error {
 	conn, _, err := websocket.DefaultDialer.Dial(DouyuDanmakuUrl, nil)
 	if err != nil {
-		logger.Error(err)
-		return
+		return err
 	}
 	logger.Infof("connect to danmaku %d", d.RoomID)
 	d.Dan = conn
-	d.ctx, d.cancel = context.WithCancel(context.Background())
-	// start listener
-	go d.listener()
+	d.reader = &douyuReader{}
 	err = d.authenticate()
 	if err != nil {
-		logger.Error(err)
-		return
+		_ = conn.Close()
+		return err
 	}
-	// start heartbeat
-	go d.heartBeat()
+	return nil
+}
+
+func (d *Douyu) serve(ctx context.Context) error {
+	return serveConn(ctx, d.Dan, d.listen(d.Dan, d.handle), d.heartBeat)
 }
@@ -0,0 +1,257 @@
+package platform
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// TestDouyuDecodeSplit feeds packets split at every point and truncated to every length,
+// the reader never panics and fails with frame errors only
+func TestDouyuDecodeSplit(t *testing.T) {
+	d := &Douyu{}
+	chat := d.encode([]byte("type@=chatmsg/rid@=1/txt@=hi/"))
+	oversized := d.encode(nil)
+	binary.LittleEndian.PutUint32(oversized[0:], DOUYU_MAX_PACKET_LENGTH+1)
+	binary.LittleEndian.PutUint32(oversized[4:], DOUYU_MAX_PACKET_LENGTH+1)
+	mismatched := d.encode([]byte("type@=mrkl/"))
+	binary.LittleEndian.PutUint32(mismatched[4:], 1)
+	short := d.encode(nil)
+	binary.LittleEndian.PutUint32(short[0:], 2)
+	binary.LittleEndian.PutUint32(short[4:], 2)
+	packets := [][]byte{
+		append(chat, chat...),
+		// short packets
+		short,
+		// oversized packets
+		oversized,
+		mismatched,
+	}
+	for _, packet := range packets {
+		for n := 0; n <= len(packet); n++ {
+			data := packet[:n]
+			for split := 0; split <= n; split++ {
+				r := &douyuReader{}
+				for _, part := range [][]byte{data[:split], data[split:]} {
+					r.Write(part)
+					messages, err := d.decode(r)
+					if err != nil {
+						if _, ok := err.(*FrameError); !ok {
+							t.Fatalf("error %v is not a frame error", err)
+						}
+						break
+					}
+					for _, message := range messages {
+						_, _ = douyuParse(message)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDouyuRoom(t *testing.T) {
+	tests := []struct {
+		name   string
+		html   []byte
+		roomID uint
+		status int
+		err    bool
+	}{
+		{name: "room", html: fixture(t, "douyu_room.html"), roomID: 9999, status: 1},
+		{name: "offline", html: []byte("$ROOM.room_id = 1;\n$ROOM.show_status = 2;"), roomID: 1, status: 2},
+		{name: "no status", html: []byte("$ROOM.room_id = 1;"), err: true},
+		{name: "not found", html: []byte("<html></html>"), err: true},
+	}
+	for _, tt := range tests {
+		roomID, status, err := douyuRoom("test", tt.html)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if roomID != tt.roomID || status != tt.status {
+			t.Errorf("%s: got room %d status %d, want %d %d", tt.name, roomID, status, tt.roomID, tt.status)
+		}
+	}
+}
+
+func TestDouyuDanmaku(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("rid") != "9999" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"error":0,"data":{"giftList":[{"id":824,"name":"荧光棒"},{"id":20000,"name":"超级火箭"}]}}`))
+	}))
+	defer server.Close()
+	giftUrl := DouyuGiftUrl
+	DouyuGiftUrl = server.URL + "/list?rid=%d"
+	defer func() {
+		DouyuGiftUrl = giftUrl
+	}()
+	gifts := (&Douyu{RoomID: 9999}).giftNames()
+
+	tests := []struct {
+		message string
+		want    *Danmaku
+	}{
+		{
+			message: "type@=chatmsg/rid@=9999/uid@=1/nn@=user/txt@=hello/col@=2/level@=10/rg@=4/bnn@=medal/bl@=5/cst@=1600000000000/",
+			want: &Danmaku{Kind: KIND_CHAT, Text: "hello", Color: "#1e87f0", UID: "1", Name: "user", Timestamp: 1600000000000,
+				Level: 10, Admin: true, Medal: &Medal{Name: "medal", Level: 5}},
+		},
+		{
+			message: "type@=dgb/rid@=9999/gfid@=824/gfcnt@=10/hits@=30/uid@=2/nn@=user2/level@=3/",
+			want: &Danmaku{Kind: KIND_GIFT, Text: "user2 送出 荧光棒 x10", Color: "#ffffff", UID: "2", Name: "user2", Level: 3,
+				Gift: &Gift{ID: "824", Name: "荧光棒", Count: 10}},
+		},
+		// gfcnt is missing in single gifts and names of unknown gifts are empty
+		{
+			message: "type@=dgb/rid@=9999/gfid@=1/uid@=2/nn@=user2/",
+			want:    &Danmaku{Kind: KIND_GIFT, Text: "user2 送出  x1", Color: "#ffffff", UID: "2", Name: "user2", Gift: &Gift{ID: "1", Count: 1}},
+		},
+		{
+			message: "type@=uenter/rid@=9999/uid@=3/nn@=user3/level@=20/",
+			want:    &Danmaku{Kind: KIND_ENTRY, Text: "user3 进入直播间", Color: "#ffffff", UID: "3", Name: "user3", Level: 20},
+		},
+		{
+			message: "type@=rss/rid@=9999/ss@=1/code@=0/",
+			want:    &Danmaku{Kind: KIND_STATUS, Text: "直播开始", Color: "#ffffff", Status: &LiveStatus{Event: STATUS_LIVE}},
+		},
+		{
+			message: "type@=rss/rid@=9999/ss@=0/code@=0/",
+			want:    &Danmaku{Kind: KIND_STATUS, Text: "直播结束", Color: "#ffffff", Status: &LiveStatus{Event: STATUS_OFFLINE}},
+		},
+		{message: "type@=mrkl/"},
+	}
+	for _, tt := range tests {
+		message, err := douyuParse(tt.message)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.message, err)
+		}
+		danmaku := douyuDanmaku(message, gifts)
+		if tt.want == nil {
+			if danmaku != nil {
+				t.Errorf("%s: got %+v, want nil", tt.message, danmaku)
+			}
+			continue
+		}
+		if danmaku == nil {
+			t.Errorf("%s: got nil", tt.message)
+			continue
+		}
+		if gjson.GetBytes(danmaku.Raw, "type").String() != message.Type {
+			t.Errorf("%s: raw %s", tt.message, danmaku.Raw)
+		}
+		danmaku.Raw = nil
+		// messages without cst are stamped when received
+		if tt.want.Timestamp == 0 {
+			danmaku.Timestamp = 0
+		}
+		tt.want.Type = DANMAKU_SCROLL
+		if !reflect.DeepEqual(danmaku, tt.want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", tt.message, danmaku, tt.want)
+		}
+	}
+}
+
+func TestDouyuOnline(t *testing.T) {
+	room := gjson.Parse(`{"room_id":9999,"room_biz_all":{"hot":"123456"}}`)
+	if online := douyuOnline(room); online != 123456 {
+		t.Errorf("got %d, want 123456", online)
+	}
+}
+
+// the room page in testdata is reconstructed, its ub98484234 is an unobfuscated script
+// with the signing steps douyuSign assumes, so the test only guards the two signers
+// against drifting apart, not against changes of douyu
+func TestDouyuSign(t *testing.T) {
+	html := fixture(t, "douyu_room.html")
+	for _, tt := range []int64{0, 1700000000, 1893456000} {
+		native, err := douyuSign(html, 9999, tt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		js, err := douyuSignJS(html, 9999, tt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if native != js {
+			t.Errorf("tt %d: douyuSign %s, douyuSignJS %s", tt, native, js)
+		}
+	}
+	if _, err := douyuSign([]byte("<html></html>"), 9999, 0); err == nil {
+		t.Error("signed without version in page")
+	}
+}
+
+func TestDouyuPlayFallback(t *testing.T) {
+	// a version of its own keeps the test away from versions cached by others
+	html := bytes.Replace(fixture(t, "douyu_room.html"), []byte("220120230101"), []byte("1111"), 1)
+	douyuRejectedVersions.Delete("1111")
+	var calls int
+	down := errors.New("network down")
+	play := func(err error, codes ...int64) func(params string) (gjson.Result, error) {
+		return func(params string) (gjson.Result, error) {
+			code := codes[calls]
+			calls++
+			return gjson.Parse(fmt.Sprintf(`{"error":%d}`, code)), err
+		}
+	}
+	// a network error doesn't reject the native sign
+	if _, _, err := douyuPlay(html, 9999, 1700000000, play(down, 0)); err != down || calls != 1 {
+		t.Fatalf("got %v after %d calls", err, calls)
+	}
+	calls = 0
+	if _, _, err := douyuPlay(html, 9999, 1700000000, play(nil, -5, 0)); err != nil || calls != 2 {
+		t.Fatalf("got %v after %d calls, want js fallback", err, calls)
+	}
+	// native sign of the rejected version is skipped
+	calls = 0
+	if _, _, err := douyuPlay(html, 9999, 1700000000, play(nil, 0)); err != nil || calls != 1 {
+		t.Fatalf("got %v after %d calls, want js only", err, calls)
+	}
+	calls = 0
+	if _, _, err := douyuPlay(html, 9999, 1700000000, play(nil, -5)); err == nil || calls != 1 {
+		t.Fatalf("got %v after %d calls, want rejected js", err, calls)
+	}
+}
+
+func TestDouyuPlayError(t *testing.T) {
+	if err := douyuPlayError(gjson.Parse(`{"error":0,"data":{}}`)); err != nil {
+		t.Errorf("got %v on success", err)
+	}
+	if err := douyuPlayError(gjson.Parse(`{"error":-5,"msg":"鉴权失败"}`)); err == nil {
+		t.Error("no error on rejected sign")
+	}
+}
+
+func BenchmarkDouyuSign(b *testing.B) {
+	html, err := ioutil.ReadFile("testdata/douyu_room.html")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = douyuSign(html, 9999, 1700000000)
+	}
+}
+
+func BenchmarkDouyuSignJS(b *testing.B) {
+	html, err := ioutil.ReadFile("testdata/douyu_room.html")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = douyuSignJS(html, 9999, 1700000000)
+	}
+}
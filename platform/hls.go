@@ -0,0 +1,71 @@
+package platform
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var hlsAttributeRe = regexp.MustCompile(`([A-Z0-9-]+)=("[^"]*"|[^,]*)`)
+
+// variant stream in a hls master playlist
+type hlsVariant struct {
+	Name       string
+	Bandwidth  uint64
+	Resolution string
+	Url        string
+}
+
+func hlsAttributes(line string) map[string]string {
+	attributes := map[string]string{}
+	for _, m := range hlsAttributeRe.FindAllStringSubmatch(line, -1) {
+		attributes[m[1]] = strings.Trim(m[2], `"`)
+	}
+	return attributes
+}
+
+// parseMasterPlaylist lists variants in playlist order, variants are named by
+// the NAME of their video rendition if present, then by resolution
+func parseMasterPlaylist(data []byte) []hlsVariant {
+	var variants []hlsVariant
+	names := map[string]string{}
+	var current *hlsVariant
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:"):
+			attributes := hlsAttributes(line)
+			if attributes["TYPE"] == "VIDEO" {
+				names[attributes["GROUP-ID"]] = attributes["NAME"]
+			}
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			attributes := hlsAttributes(line)
+			bandwidth, _ := strconv.ParseUint(attributes["BANDWIDTH"], 10, 64)
+			name := names[attributes["VIDEO"]]
+			if name == "" {
+				name = attributes["RESOLUTION"]
+			}
+			if name == "" {
+				name = attributes["VIDEO"]
+			}
+			current = &hlsVariant{
+				Name:       name,
+				Bandwidth:  bandwidth,
+				Resolution: attributes["RESOLUTION"],
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			// uri line belongs to the last stream info
+			if current != nil {
+				current.Url = line
+				variants = append(variants, *current)
+				current = nil
+			}
+		}
+	}
+	return variants
+}
@@ -0,0 +1,45 @@
+package platform
+
+import (
+	"reflect"
+	"testing"
+)
+
+// playlists in testdata are written after the twitch usher response and the hls
+// spec examples, urls and session attributes are made up
+func TestParseMasterPlaylist(t *testing.T) {
+	tests := []struct {
+		playlist string
+		variants []hlsVariant
+	}{
+		{
+			playlist: "twitch_master.m3u8",
+			variants: []hlsVariant{
+				{"1080p60 (source)", 6000000, "1920x1080", "https://video-weaver.sjc02.hls.ttvnw.net/v1/playlist/source.m3u8"},
+				{"720p60", 3422999, "1280x720", "https://video-weaver.sjc02.hls.ttvnw.net/v1/playlist/720p60.m3u8"},
+				{"480p", 1427999, "852x480", "https://video-weaver.sjc02.hls.ttvnw.net/v1/playlist/480p30.m3u8"},
+				{"audio_only", 160000, "", "https://video-weaver.sjc02.hls.ttvnw.net/v1/playlist/audio_only.m3u8"},
+			},
+		},
+		{
+			playlist: "plain_master.m3u8",
+			variants: []hlsVariant{
+				{"1280x720", 2500000, "1280x720", "720/index.m3u8"},
+				{"640x360", 800000, "640x360", "360/index.m3u8"},
+				{"audio", 64000, "", "audio/index.m3u8"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		variants := parseMasterPlaylist(fixture(t, tt.playlist))
+		if !reflect.DeepEqual(variants, tt.variants) {
+			t.Errorf("%s: got %+v, want %+v", tt.playlist, variants, tt.variants)
+		}
+	}
+}
+
+func TestParseMasterPlaylistEmpty(t *testing.T) {
+	if variants := parseMasterPlaylist([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n")); len(variants) != 0 {
+		t.Fatalf("got %+v from playlist without uri", variants)
+	}
+}
@@ -0,0 +1,288 @@
+package platform
+
+import (
+	"github.com/gorilla/websocket"
+	"sync"
+)
+
+// Hub owns danmaku rooms, rooms are registered by index like "type:room id" and
+// unregistered when closed. rooms are connected to upstream once
+type Hub struct {
+	mu        sync.Mutex
+	rooms     map[string]Room
+	connected map[Room]bool
+}
+
+var hub = &Hub{
+	rooms:     map[string]Room{},
+	connected: map[Room]bool{},
+}
+
+// Get returns the room of index, nil if not exists
+func (h *Hub) Get(index string) Room {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rooms[index]
+}
+
+// Load returns the room of index, a new one made by create is registered if there is no
+// room or the room is closed
+func (h *Hub) Load(index string, create func() Room) Room {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room := h.rooms[index]
+	if room == nil || room.IsClosed() {
+		room = create()
+		h.rooms[index] = room
+	}
+	return room
+}
+
+// Delete unregisters room, a newer room of the same index is kept
+func (h *Hub) Delete(index string, room Room) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rooms[index] == room {
+		delete(h.rooms, index)
+	}
+	delete(h.connected, room)
+}
+
+// Len returns count of rooms
+func (h *Hub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.rooms)
+}
+
+// Connect connects room to upstream if it's not connected, clients joining a room at
+// the same time don't connect it twice. a room closed before, e.g. its last client left
+// after joining, is not connected since Delete has run for it
+func (h *Hub) Connect(room Room) {
+	h.mu.Lock()
+	// room is closed before it's deleted, so it's never connected after Delete
+	if room.IsClosed() {
+		h.mu.Unlock()
+		return
+	}
+	connected := h.connected[room]
+	h.connected[room] = true
+	h.mu.Unlock()
+	if !connected {
+		room.Connect()
+	}
+}
+
+// QueuePolicy decides what to do with a slow client whose queue is full
+type QueuePolicy string
+
+const (
+	QUEUE_DROP_OLDEST QueuePolicy = "drop-oldest"
+	QUEUE_DROP_NEWEST QueuePolicy = "drop-newest"
+	QUEUE_DISCONNECT  QueuePolicy = "disconnect"
+)
+
+var (
+	DefaultQueuePolicy = QUEUE_DROP_OLDEST
+	// danmaku waiting to be written to a client
+	ClientQueueSize = 256
+)
+
+func (p QueuePolicy) Valid() bool {
+	return p == QUEUE_DROP_OLDEST || p == QUEUE_DROP_NEWEST || p == QUEUE_DISCONNECT
+}
+
+// RoomMetrics are client metrics of a room
+type RoomMetrics struct {
+	Room    string `json:"room"`
+	Clients int    `json:"clients"`
+	// danmaku dropped by full queues
+	Dropped uint64 `json:"dropped"`
+	// clients disconnected by full queues
+	Evicted uint64 `json:"evicted"`
+}
+
+// Metrics returns metrics of all rooms
+func (h *Hub) Metrics() []RoomMetrics {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	metrics := make([]RoomMetrics, 0, len(h.rooms))
+	for index, room := range h.rooms {
+		m := room.GetClients().Metrics()
+		m.Room = index
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// client has its own queue and writer, so a slow client doesn't block others
+type client struct {
+	conn   *websocket.Conn
+	raw    bool
+	policy QueuePolicy
+	queue  chan *Danmaku
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newClient(conn *websocket.Conn) *client {
+	c := &client{
+		conn:   conn,
+		policy: DefaultQueuePolicy,
+		queue:  make(chan *Danmaku, ClientQueueSize),
+		done:   make(chan struct{}),
+	}
+	go c.writer()
+	return c
+}
+
+// writer writes queued danmaku, a failed client is closed and then removed by its reader
+func (c *client) writer() {
+	for {
+		select {
+		case danmaku := <-c.queue:
+			err := c.conn.WriteJSON(danmaku)
+			if err != nil {
+				_ = c.conn.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// stop stops writer, it can be called more than once
+func (c *client) stop() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+// Clients are danmaku clients of a room, they are closed with the room and no client
+// can be added after that
+type Clients struct {
+	mu      sync.Mutex
+	clients map[*websocket.Conn]*client
+	closed  bool
+	dropped uint64
+	evicted uint64
+}
+
+func NewClients() *Clients {
+	return &Clients{
+		clients: map[*websocket.Conn]*client{},
+	}
+}
+
+// Add adds conn, it returns false if clients are closed
+func (c *Clients) Add(conn *websocket.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.clients[conn] = newClient(conn)
+	return true
+}
+
+// SetRaw sets whether conn wants raw messages
+func (c *Clients) SetRaw(conn *websocket.Conn, raw bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.clients[conn]; ok {
+		client.raw = raw
+	}
+}
+
+// SetPolicy sets queue policy of conn, a client can't change how others are handled
+func (c *Clients) SetPolicy(conn *websocket.Conn, policy QueuePolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.clients[conn]; ok {
+		client.policy = policy
+	}
+}
+
+// Remove removes conn and returns count of remaining clients
+func (c *Clients) Remove(conn *websocket.Conn) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.clients[conn]; ok {
+		client.stop()
+		delete(c.clients, conn)
+	}
+	return len(c.clients)
+}
+
+func (c *Clients) Metrics() RoomMetrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return RoomMetrics{
+		Clients: len(c.clients),
+		Dropped: c.dropped,
+		Evicted: c.evicted,
+	}
+}
+
+func (c *Clients) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.clients)
+}
+
+func (c *Clients) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// Broadcast queues danmaku to all clients, full queues are handled by policy of the client.
+// it returns count of remaining clients
+func (c *Clients) Broadcast(danmaku *Danmaku) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for conn, client := range c.clients {
+		message := danmakuFor(client.raw, danmaku)
+		select {
+		case client.queue <- message:
+			continue
+		default:
+		}
+		switch client.policy {
+		case QUEUE_DROP_NEWEST:
+			c.dropped++
+		case QUEUE_DISCONNECT:
+			logger.Infof("client %+v disconnected since it's too slow", conn.RemoteAddr())
+			client.stop()
+			_ = conn.Close()
+			delete(c.clients, conn)
+			c.evicted++
+		default:
+			// only broadcast puts into queue and it holds the lock, so there is room after taking one
+			select {
+			case <-client.queue:
+				c.dropped++
+			default:
+			}
+			client.queue <- message
+		}
+	}
+	return len(c.clients)
+}
+
+// Close closes all clients, it returns false if clients are already closed
+func (c *Clients) Close() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.closed = true
+	for conn, client := range c.clients {
+		client.stop()
+		_ = conn.Close()
+		delete(c.clients, conn)
+	}
+	return true
+}
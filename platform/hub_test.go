@@ -0,0 +1,274 @@
+package platform
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testRoom is a danmaku room without upstream
+type testRoom struct {
+	*BaseRoom
+	connected chan struct{}
+}
+
+func (r *testRoom) GetLiveInfo() (*Platform, error) {
+	return &Platform{}, nil
+}
+
+func (r *testRoom) Connect() {
+	close(r.connected)
+}
+
+func newTestRoom(index string) func() Room {
+	return func() Room {
+		room := &testRoom{connected: make(chan struct{})}
+		room.BaseRoom = newBaseRoom(Type(1000), index, room)
+		return room
+	}
+}
+
+// danmakuServer joins every websocket client to the test room of index and sends joined rooms
+func danmakuServer(t *testing.T, index string) (string, <-chan Room) {
+	return roomServer(t, roomIndex(Type(1000), index), newTestRoom(index))
+}
+
+// roomServer joins every websocket client to the room of index made by create
+func roomServer(t *testing.T, index string, create func() Room) (string, <-chan Room) {
+	upgrader := websocket.Upgrader{}
+	rooms := make(chan Room, 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		room := joinRoom(index, create, conn)
+		hub.Connect(room)
+		rooms <- room
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http"), rooms
+}
+
+func dialDanmaku(t *testing.T, url string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+func TestCloseRoomWithClients(t *testing.T) {
+	url, rooms := danmakuServer(t, "close")
+	first := dialDanmaku(t, url)
+	second := dialDanmaku(t, url)
+	room := <-rooms
+	if <-rooms != room {
+		t.Fatal("clients joined different rooms")
+	}
+	room.Close()
+	// readers of server remove closed clients after close
+	for _, conn := range []*websocket.Conn{first, second} {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := conn.ReadMessage()
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			t.Fatal("client not closed")
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !room.IsClosed() || room.GetClients().Len() != 0 {
+		t.Fatalf("room closed %v with %d clients", room.IsClosed(), room.GetClients().Len())
+	}
+	if hub.Get(roomIndex(Type(1000), "close")) != nil {
+		t.Fatal("closed room is still in hub")
+	}
+}
+
+func TestClientsRemoveTwice(t *testing.T) {
+	url, rooms := danmakuServer(t, "remove")
+	dialDanmaku(t, url)
+	room := <-rooms
+	clients := room.GetClients()
+	var conn *websocket.Conn
+	clients.mu.Lock()
+	for c := range clients.clients {
+		conn = c
+	}
+	clients.mu.Unlock()
+	clients.Remove(conn)
+	clients.Remove(conn)
+	room.Close()
+}
+
+func TestHubStress(t *testing.T) {
+	const (
+		rooms   = 3
+		workers = 20
+		rounds  = 10
+	)
+	urls := make([]string, rooms)
+	for i := range urls {
+		urls[i], _ = danmakuServer(t, fmt.Sprintf("stress-%d", i))
+	}
+	done := make(chan struct{})
+	var broadcaster sync.WaitGroup
+	broadcaster.Add(1)
+	go func() {
+		defer broadcaster.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for i := 0; i < rooms; i++ {
+				if room := hub.Get(roomIndex(Type(1000), fmt.Sprintf("stress-%d", i))); room != nil {
+					room.Send(&Danmaku{Kind: KIND_CHAT, Text: "stress"})
+					_ = hub.Metrics()
+				}
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				conn, _, err := websocket.DefaultDialer.Dial(urls[(w+r)%rooms], nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_ = conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+				_, _, _ = conn.ReadMessage()
+				_ = conn.Close()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	broadcaster.Wait()
+	// the last readers of server see closed clients and close the rooms
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; i < rooms; i++ {
+		index := roomIndex(Type(1000), fmt.Sprintf("stress-%d", i))
+		for hub.Get(index) != nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if hub.Get(index) != nil {
+			t.Fatalf("room %s not closed after all clients left", index)
+		}
+	}
+}
+
+func TestConnectClosedRoom(t *testing.T) {
+	// the last client left after joining the room but before InitDanmaku connects it
+	room := newTestRoom("connect-closed")()
+	room.Close()
+	hub.Connect(room)
+	select {
+	case <-room.(*testRoom).connected:
+		t.Fatal("closed room connected")
+	default:
+	}
+	hub.mu.Lock()
+	_, leaked := hub.connected[room]
+	hub.mu.Unlock()
+	if leaked {
+		t.Fatal("closed room left in connected rooms")
+	}
+}
+
+// blockedClient adds a client whose writer is stopped, so its queue is never drained
+func blockedClient(t *testing.T, clients *Clients, policy QueuePolicy) *websocket.Conn {
+	upgrader := websocket.Upgrader{}
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+	dialDanmaku(t, "ws"+strings.TrimPrefix(server.URL, "http"))
+	conn := <-conns
+	clients.Add(conn)
+	if policy != "" {
+		clients.SetPolicy(conn, policy)
+	}
+	clients.mu.Lock()
+	clients.clients[conn].stop()
+	clients.mu.Unlock()
+	return conn
+}
+
+func queued(clients *Clients, conn *websocket.Conn) []string {
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+	client, ok := clients.clients[conn]
+	if !ok {
+		return nil
+	}
+	var texts []string
+	for len(client.queue) > 0 {
+		texts = append(texts, (<-client.queue).Text)
+	}
+	return texts
+}
+
+func TestQueuePolicy(t *testing.T) {
+	size := ClientQueueSize
+	ClientQueueSize = 2
+	defer func() {
+		ClientQueueSize = size
+	}()
+	tests := []struct {
+		policy  QueuePolicy
+		queued  []string
+		dropped uint64
+		evicted uint64
+	}{
+		// empty policy is the default one
+		{"", []string{"3", "4"}, 2, 0},
+		{QUEUE_DROP_OLDEST, []string{"3", "4"}, 2, 0},
+		{QUEUE_DROP_NEWEST, []string{"1", "2"}, 2, 0},
+		{QUEUE_DISCONNECT, nil, 0, 1},
+	}
+	for _, tt := range tests {
+		clients := NewClients()
+		conn := blockedClient(t, clients, tt.policy)
+		// policy of a client doesn't change others
+		other := blockedClient(t, clients, "")
+		for _, text := range []string{"1", "2", "3", "4"} {
+			clients.Broadcast(&Danmaku{Text: text})
+		}
+		if got := queued(clients, conn); !reflect.DeepEqual(got, tt.queued) {
+			t.Errorf("%s: queued %v, want %v", tt.policy, got, tt.queued)
+		}
+		if got := queued(clients, other); !reflect.DeepEqual(got, []string{"3", "4"}) {
+			t.Errorf("%s: other client queued %v", tt.policy, got)
+		}
+		m := clients.Metrics()
+		// the other client drops 2 too
+		if m.Dropped != tt.dropped+2 || m.Evicted != tt.evicted {
+			t.Errorf("%s: dropped %d evicted %d, want %d %d", tt.policy, m.Dropped, m.Evicted, tt.dropped+2, tt.evicted)
+		}
+		if want := 2 - int(tt.evicted); m.Clients != want {
+			t.Errorf("%s: %d clients, want %d", tt.policy, m.Clients, want)
+		}
+		clients.Close()
+	}
+}
@@ -0,0 +1,288 @@
+package platform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"live/util"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	HuyaBaseUrl   = "https://www.huya.com/%s"
+	HuyaUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/84.0.4147.105 Safari/537.36"
+)
+
+const (
+	HUYA_WS_CMD_REGISTER_REQ = 1
+	HUYA_WS_CMD_HEARTBEAT    = 5
+	HUYA_WS_CMD_MSG_PUSH     = 7
+	HUYA_URI_MESSAGE_NOTICE  = 1400
+)
+
+// danmaku server is a var so that tests can replace it with a local one
+var HuyaDanmakuUrl = "wss://cdnws.api.huya.com"
+
+var (
+	HuyaRoomIDRe     = regexp.MustCompile(`"profileRoom":"?(\d+)`)
+	HuyaStreamRe     = regexp.MustCompile(`stream:\s*\{`)
+	HuyaYyidRe       = regexp.MustCompile(`"lYyid":"?(\d+)`)
+	HuyaChannelRe    = regexp.MustCompile(`"lChannelId":"?(\d+)`)
+	HuyaSubChannelRe = regexp.MustCompile(`"lSubChannelId":"?(\d+)`)
+)
+
+const HUYA Type = 2
+
+var HuyaRoomUrlRe = regexp.MustCompile(`^(?:www\.|m\.)?huya\.com/(\w+)`)
+
+// pages matched by room url pattern
+var HuyaReservedPaths = []string{"g", "l", "e", "video", "download", "info", "search", "directory", "act", "zt", "cache"}
+
+func init() {
+	Register(&Adapter{
+		Type:         HUYA,
+		Name:         "huya",
+		Capabilities: Capabilities{Danmaku: true},
+		URL:          HuyaRoomUrlRe,
+		Reserved:     HuyaReservedPaths,
+		New:          GetHuyaRoom,
+	})
+}
+
+type Huya struct {
+	*BaseRoom
+	RoomID  uint
+	Quality uint
+	Status  int
+	Dan     *websocket.Conn
+	// stream info embedded in room page
+	stream gjson.Result
+	// ids used by danmaku register
+	yyid       uint64
+	channel    uint64
+	subChannel uint64
+}
+
+func GetHuyaRoom(id string, quality uint, client *websocket.Conn) (Room, error) {
+	// get real room id
+	html, err := util.Request("GET", fmt.Sprintf(HuyaBaseUrl, id), "", map[string]string{
+		"User-Agent": HuyaUserAgent,
+	})
+	if err != nil {
+		return nil, err
+	}
+	room, err := huyaRoom(id, html)
+	if err != nil {
+		return nil, err
+	}
+	room.Quality = quality
+	if client == nil {
+		return room, nil
+	}
+	return joinRoom(roomIndex(HUYA, fmt.Sprint(room.RoomID)), func() Room {
+		_room := *room
+		_room.BaseRoom = newBaseRoom(HUYA, fmt.Sprint(room.RoomID), &_room)
+		return &_room
+	}, client), nil
+}
+
+// huyaRoom parses the room page of id
+func huyaRoom(id string, html []byte) (*Huya, error) {
+	r := HuyaRoomIDRe.FindSubmatch(html)
+	if len(r) == 0 {
+		return nil, errors.New(fmt.Sprintf("room %s not found", id))
+	}
+	roomID, err := strconv.Atoi(string(r[1]))
+	if err != nil {
+		return nil, err
+	}
+	// get stream info, it's a json object in hyPlayerConfig, offline rooms have an empty stream
+	stream, err := pageJSON(html, HuyaStreamRe)
+	if err != nil {
+		return nil, err
+	}
+	status := 0
+	if stream.Get("data.0.gameStreamInfoList.#").Int() > 0 {
+		status = 1
+	}
+	return &Huya{
+		RoomID:     uint(roomID),
+		Status:     status,
+		stream:     stream,
+		yyid:       huyaID(HuyaYyidRe, html),
+		channel:    huyaID(HuyaChannelRe, html),
+		subChannel: huyaID(HuyaSubChannelRe, html),
+	}, nil
+}
+
+func huyaID(re *regexp.Regexp, html []byte) uint64 {
+	r := re.FindSubmatch(html)
+	if len(r) == 0 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(r[1]), 10, 64)
+	return id
+}
+
+func (h *Huya) GetLiveInfo() (*Platform, error) {
+	if h.Status != 1 {
+		return &Platform{
+			Type:           HUYA,
+			RoomID:         fmt.Sprint(h.RoomID),
+			Status:         0,
+			CurrentQuality: h.Quality,
+		}, nil
+	}
+	var qualities []Quality
+	h.stream.Get("vMultiStreamInfo").ForEach(func(key, value gjson.Result) bool {
+		qualities = append(qualities, Quality{
+			Quality:     value.Get("iBitRate").Uint(),
+			Description: value.Get("sDisplayName").String(),
+		})
+		return true
+	})
+	// first stream is the default cdn
+	info := h.stream.Get("data.0.gameStreamInfoList.0")
+	link := fmt.Sprintf("%s/%s.%s?%s",
+		info.Get("sFlvUrl").String(),
+		info.Get("sStreamName").String(),
+		info.Get("sFlvUrlSuffix").String(),
+		info.Get("sFlvAntiCode").String())
+	// ratio 0 means original quality
+	if h.Quality != 0 {
+		link += fmt.Sprintf("&ratio=%d", h.Quality)
+	}
+	return &Platform{
+		Type:           HUYA,
+		RoomID:         fmt.Sprint(h.RoomID),
+		Status:         uint(h.Status),
+		CurrentQuality: h.Quality,
+		Link:           link,
+		Qualities:      qualities,
+	}, nil
+}
+
+// danmaku data structure
+// every frame is a tars encoded WebSocketCommand
+// +-----------+-------------------------------------+
+// |   TAG 0   |                TAG 1                |
+// +-----------+-------------------------------------+
+// | iCmdType  |   vData (tars encoded, by command)  |
+// +-----------+-------------------------------------+
+// pushed danmaku is a WSPushMessage with iUri 1400 (MessageNotice) in vData
+// source: https://github.com/IsoaSFlus/danmaku/blob/master/danmaku/huya.py
+func (h *Huya) encode(data []byte, cmd int) []byte {
+	w := &tarsWriter{}
+	w.Int(0, int64(cmd))
+	w.Bytes(1, data)
+	return w.Data()
+}
+
+func (h *Huya) decode(raw []byte) ([]tarsStruct, error) {
+	command, err := tarsUnmarshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var res []tarsStruct
+	switch command.Int(0) {
+	case HUYA_WS_CMD_MSG_PUSH:
+		push, err := tarsUnmarshal(command.Bytes(1))
+		if err != nil {
+			return nil, err
+		}
+		if push.Int(1) != HUYA_URI_MESSAGE_NOTICE {
+			break
+		}
+		notice, err := tarsUnmarshal(push.Bytes(2))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, notice)
+	default:
+		logger.Debugf("huya command %d", command.Int(0))
+	}
+	return res, nil
+}
+
+func (h *Huya) authenticate() error {
+	// WSUserInfo, anonymous user joins the room group of the streamer
+	w := &tarsWriter{}
+	w.Int(0, int64(h.yyid))
+	w.Bool(1, true)
+	w.String(2, "")
+	w.String(3, "")
+	w.Int(4, int64(h.channel))
+	w.Int(5, int64(h.subChannel))
+	w.Int(6, int64(h.yyid))
+	w.Int(7, 3)
+	return h.Dan.WriteMessage(websocket.BinaryMessage, h.encode(w.Data(), HUYA_WS_CMD_REGISTER_REQ))
+}
+
+func (h *Huya) heartBeat(ctx context.Context) error {
+	defer logger.Infof("heartbeat of room %d exited", h.RoomID)
+	data := h.encode(nil, HUYA_WS_CMD_HEARTBEAT)
+	ticker := time.NewTicker(time.Second * 60)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := h.Dan.WriteMessage(websocket.BinaryMessage, data)
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// handle converts notices of a frame to danmaku
+func (h *Huya) handle(raw []byte) ([]*Danmaku, error) {
+	res, err := h.decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	var danmakus []*Danmaku
+	for _, notice := range res {
+		color := "#ffffff"
+		// -1 is the default color
+		if c := notice.Struct(6).Int(0); c > 0 {
+			color = fmt.Sprintf("#%06x", c)
+		}
+		// tUserInfo: 0 lUid, 2 sNickName
+		user := notice.Struct(0)
+		danmakus = append(danmakus, &Danmaku{
+			Kind:      KIND_CHAT,
+			Text:      notice.String(3),
+			Color:     color,
+			Type:      DANMAKU_SCROLL,
+			UID:       fmt.Sprint(user.Int(0)),
+			Name:      user.String(2),
+			Timestamp: nowMillis(),
+		})
+	}
+	return danmakus, nil
+}
+
+func (h *Huya) dial() error {
+	conn, _, err := websocket.DefaultDialer.Dial(HuyaDanmakuUrl, nil)
+	if err != nil {
+		return err
+	}
+	logger.Infof("connect to danmaku %d", h.RoomID)
+	h.Dan = conn
+	err = h.authenticate()
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (h *Huya) serve(ctx context.Context) error {
+	return serveConn(ctx, h.Dan, h.listen(h.Dan, h.handle), h.heartBeat)
+}
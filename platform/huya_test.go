@@ -0,0 +1,230 @@
+package platform
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// room pages in testdata are reconstructed from the layout of huya room pages,
+// they keep the fields read by huyaRoom only
+func TestHuyaRoom(t *testing.T) {
+	const link = "https://al.flv.huya.com/src/1199511794-1199511794-5151320210573574144-2399023044-10057-A-0-1.flv?" +
+		"wsSecret=0123456789abcdef&wsTime=65000000&fm=RFdxOEJjSjNoNkRKdDZUWV8kMF8kMV8kMl8kMw%3D%3D&ctype=huya_live&fs=bgct&t=100"
+	tests := []struct {
+		page    string
+		quality uint
+		status  uint
+		// yyid and channels are only in the stream of living rooms
+		id        uint64
+		link      string
+		qualities []Quality
+	}{
+		{page: "huya_offline.html", status: 0},
+		{
+			page:   "huya_live.html",
+			status: 1,
+			id:     1199511794,
+			link:   link,
+			qualities: []Quality{
+				{Quality: 8000, Description: "蓝光8M"},
+				{Quality: 4000, Description: "蓝光4M"},
+				{Quality: 2000, Description: "超清"},
+				{Quality: 500, Description: "流畅"},
+			},
+		},
+		{
+			page:    "huya_live.html",
+			quality: 2000,
+			status:  1,
+			id:      1199511794,
+			link:    link + "&ratio=2000",
+			qualities: []Quality{
+				{Quality: 8000, Description: "蓝光8M"},
+				{Quality: 4000, Description: "蓝光4M"},
+				{Quality: 2000, Description: "超清"},
+				{Quality: 500, Description: "流畅"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		room, err := huyaRoom("test", fixture(t, tt.page))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.page, err)
+		}
+		if room.RoomID != 11342412 {
+			t.Errorf("%s: room id %d, want 11342412", tt.page, room.RoomID)
+		}
+		if room.yyid != tt.id || room.channel != tt.id || room.subChannel != tt.id {
+			t.Errorf("%s: ids %d %d %d, want %d", tt.page, room.yyid, room.channel, room.subChannel, tt.id)
+		}
+		room.Quality = tt.quality
+		info, err := room.GetLiveInfo()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.page, err)
+		}
+		if info.Status != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.page, info.Status, tt.status)
+		}
+		if info.Link != tt.link {
+			t.Errorf("%s: link %s, want %s", tt.page, info.Link, tt.link)
+		}
+		if !reflect.DeepEqual(info.Qualities, tt.qualities) {
+			t.Errorf("%s: qualities %+v, want %+v", tt.page, info.Qualities, tt.qualities)
+		}
+	}
+}
+
+func TestHuyaRoomNotFound(t *testing.T) {
+	_, err := huyaRoom("test", []byte("<html><body>404</body></html>"))
+	if err == nil {
+		t.Fatal("room found in empty page")
+	}
+}
+
+// huyaPush makes a pushed frame of uri, 1400 is MessageNotice
+func huyaPush(uri int64, uid int64, name, text string, color int64) []byte {
+	notice := &tarsWriter{}
+	notice.Struct(0, func(w *tarsWriter) {
+		w.Int(0, uid)
+		w.String(2, name)
+	})
+	notice.String(3, text)
+	notice.Struct(6, func(w *tarsWriter) {
+		w.Int(0, color)
+	})
+	push := &tarsWriter{}
+	push.Int(0, 0)
+	push.Int(1, uri)
+	push.Bytes(2, notice.Data())
+	return (&Huya{}).encode(push.Data(), HUYA_WS_CMD_MSG_PUSH)
+}
+
+func TestHuyaHeartbeat(t *testing.T) {
+	command, err := tarsUnmarshal((&Huya{}).encode(nil, HUYA_WS_CMD_HEARTBEAT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command.Int(0) != HUYA_WS_CMD_HEARTBEAT || len(command.Bytes(1)) != 0 {
+		t.Fatalf("got heartbeat %v", command)
+	}
+}
+
+func TestHuyaDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		texts []string
+		err   bool
+	}{
+		{name: "notice", frame: huyaPush(HUYA_URI_MESSAGE_NOTICE, 1, "user", "hello", 0xff0000), texts: []string{"hello"}},
+		{name: "other push", frame: huyaPush(1001, 1, "user", "hello", -1)},
+		{name: "heartbeat", frame: (&Huya{}).encode(nil, HUYA_WS_CMD_HEARTBEAT)},
+		{name: "short", frame: huyaPush(HUYA_URI_MESSAGE_NOTICE, 1, "user", "hello", 0)[:8], err: true},
+	}
+	for _, tt := range tests {
+		res, err := (&Huya{}).decode(tt.frame)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		var texts []string
+		for _, notice := range res {
+			texts = append(texts, notice.String(3))
+		}
+		if !reflect.DeepEqual(texts, tt.texts) {
+			t.Errorf("%s: got %q, want %q", tt.name, texts, tt.texts)
+		}
+	}
+}
+
+// huyaServer stands in for huya danmaku server, it sends frames read from the room
+// and writes frames sent to push
+func huyaServer(t *testing.T) (<-chan tarsStruct, chan<- []byte) {
+	upgrader := websocket.Upgrader{}
+	frames := make(chan tarsStruct, 16)
+	push := make(chan []byte, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go func() {
+			for data := range push {
+				if conn.WriteMessage(websocket.BinaryMessage, data) != nil {
+					return
+				}
+			}
+		}()
+		for {
+			_, raw, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			// malformed frames are left to the checks of the test
+			command, _ := tarsUnmarshal(raw)
+			frames <- command
+		}
+	}))
+	url := HuyaDanmakuUrl
+	HuyaDanmakuUrl = "ws" + strings.TrimPrefix(server.URL, "http")
+	t.Cleanup(func() {
+		HuyaDanmakuUrl = url
+		close(push)
+		server.Close()
+	})
+	return frames, push
+}
+
+func TestHuyaDanmaku(t *testing.T) {
+	frames, push := huyaServer(t)
+	room, err := huyaRoom("test", fixture(t, "huya_live.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, rooms := roomServer(t, roomIndex(HUYA, "test"), func() Room {
+		_room := *room
+		_room.BaseRoom = newBaseRoom(HUYA, "test", &_room)
+		return &_room
+	})
+	client := dialDanmaku(t, url)
+	defer (<-rooms).Close()
+
+	// WSUserInfo is registered first
+	var register tarsStruct
+	select {
+	case command := <-frames:
+		if command.Int(0) != HUYA_WS_CMD_REGISTER_REQ {
+			t.Fatalf("got command %d, want register", command.Int(0))
+		}
+		register, err = tarsUnmarshal(command.Bytes(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("room not registered")
+	}
+	for tag, want := range map[byte]int64{0: 1199511794, 1: 1, 4: 1199511794, 5: 1199511794, 6: 1199511794, 7: 3} {
+		if got := register.Int(tag); got != want {
+			t.Errorf("register tag %d is %d, want %d", tag, got, want)
+		}
+	}
+
+	push <- huyaPush(1001, 2, "other", "ignored", -1)
+	push <- huyaPush(HUYA_URI_MESSAGE_NOTICE, 1, "user", "hello", 0xff0000)
+	var danmaku Danmaku
+	_ = client.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if err := client.ReadJSON(&danmaku); err != nil {
+		t.Fatal(err)
+	}
+	if danmaku.Kind != KIND_CHAT || danmaku.Text != "hello" || danmaku.Name != "user" ||
+		danmaku.UID != "1" || danmaku.Color != "#ff0000" {
+		t.Fatalf("got danmaku %+v", danmaku)
+	}
+}
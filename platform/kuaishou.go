@@ -0,0 +1,306 @@
+package platform
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"live/util"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	KuaishouBaseUrl      = "https://live.kuaishou.com/"
+	KuaishouRoomUrl      = "https://live.kuaishou.com/u/%s"
+	KuaishouWebsocketUrl = "https://live.kuaishou.com/live_api/liveroom/websocketinfo?liveStreamId=%s"
+	KuaishouUserAgent    = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/84.0.4147.105 Safari/537.36"
+)
+
+const (
+	KS_CS_HEARTBEAT     = 1
+	KS_CS_ENTER_ROOM    = 200
+	KS_SC_HEARTBEAT_ACK = 101
+	KS_SC_ENTER_ROOM    = 300
+	KS_SC_FEED_PUSH     = 310
+	KS_COMPRESSION_GZIP = 2
+)
+
+var KuaishouStateRe = regexp.MustCompile(`window\.__INITIAL_STATE__\s*=\s*\{`)
+
+const KUAISHOU Type = 5
+
+var KuaishouRoomUrlRe = regexp.MustCompile(`^live\.kuaishou\.com/u/([\w-]+)`)
+
+func init() {
+	Register(&Adapter{
+		Type:         KUAISHOU,
+		Name:         "kuaishou",
+		Capabilities: Capabilities{Danmaku: true},
+		URL:          KuaishouRoomUrlRe,
+		ShortHosts:   []string{"v.kuaishou.com"},
+		New:          GetKuaishouRoom,
+	})
+}
+
+type Kuaishou struct {
+	*BaseRoom
+	RoomID  string
+	Quality uint
+	Status  int
+	Dan     *websocket.Conn
+	// first item of play list in the initial state of room page
+	room         gjson.Result
+	liveStreamID string
+	cookie       string
+}
+
+// kuaishouCookie gets the did cookie, room page hides stream info without it
+func kuaishouCookie() (string, error) {
+	cookies, err := util.Cookies(KuaishouBaseUrl, map[string]string{
+		"User-Agent": KuaishouUserAgent,
+	})
+	if err != nil {
+		return "", err
+	}
+	var pairs []string
+	for _, cookie := range cookies {
+		pairs = append(pairs, cookie.Name+"="+cookie.Value)
+	}
+	return strings.Join(pairs, "; "), nil
+}
+
+func GetKuaishouRoom(id string, quality uint, client *websocket.Conn) (Room, error) {
+	cookie, err := kuaishouCookie()
+	if err != nil {
+		return nil, err
+	}
+	html, err := util.Request("GET", fmt.Sprintf(KuaishouRoomUrl, url.PathEscape(id)), "", map[string]string{
+		"User-Agent": KuaishouUserAgent,
+		"Cookie":     cookie,
+	})
+	if err != nil {
+		return nil, err
+	}
+	room, err := kuaishouRoom(id, html)
+	if err != nil {
+		return nil, err
+	}
+	room.Quality = quality
+	if client == nil {
+		return room, nil
+	}
+	room.cookie = cookie
+	return joinRoom(roomIndex(KUAISHOU, room.RoomID), func() Room {
+		_room := *room
+		_room.BaseRoom = newBaseRoom(KUAISHOU, room.RoomID, &_room)
+		return &_room
+	}, client), nil
+}
+
+// kuaishouRoom parses the initial state of room page of id
+func kuaishouRoom(id string, html []byte) (*Kuaishou, error) {
+	// the initial state is a js object literal, undefined is not valid json
+	state, err := pageJSON(bytes.ReplaceAll(html, []byte(":undefined"), []byte(":null")), KuaishouStateRe)
+	if err != nil {
+		return nil, err
+	}
+	room := state.Get("liveroom.playList.0")
+	if !room.Get("author.id").Exists() {
+		return nil, errors.New(fmt.Sprintf("room %s not found", id))
+	}
+	status := 0
+	if room.Get("isLiving").Bool() {
+		status = 1
+	}
+	return &Kuaishou{
+		RoomID:       room.Get("author.id").String(),
+		Status:       status,
+		room:         room,
+		liveStreamID: room.Get("liveStream.id").String(),
+	}, nil
+}
+
+func (k *Kuaishou) GetLiveInfo() (*Platform, error) {
+	if k.Status != 1 {
+		return &Platform{
+			Type:           KUAISHOU,
+			RoomID:         k.RoomID,
+			Status:         0,
+			CurrentQuality: k.Quality,
+			Title:          k.room.Get("liveStream.caption").String(),
+		}, nil
+	}
+	// quality is the bitrate of representation, the highest one is the default
+	var qualities []Quality
+	var link, bestLink string
+	var best uint64
+	k.room.Get("liveStream.playUrls.0.adaptationSet.representation").ForEach(func(key, value gjson.Result) bool {
+		bitrate := value.Get("bitrate").Uint()
+		qualities = append(qualities, Quality{
+			Quality:     bitrate,
+			Description: value.Get("name").String(),
+		})
+		if bitrate >= best {
+			best = bitrate
+			bestLink = value.Get("url").String()
+		}
+		if uint64(k.Quality) == bitrate {
+			link = value.Get("url").String()
+		}
+		return true
+	})
+	if link == "" {
+		link = bestLink
+	}
+	return &Platform{
+		Type:           KUAISHOU,
+		RoomID:         k.RoomID,
+		Status:         uint(k.Status),
+		CurrentQuality: k.Quality,
+		Link:           link,
+		Qualities:      qualities,
+		Title:          k.room.Get("liveStream.caption").String(),
+	}, nil
+}
+
+// danmaku data structure
+// every frame is a protobuf SocketMessage: 1 payloadType, 2 compressionType, 3 payload
+// SCWebFeedPush:  5 commentFeeds
+// WebCommentFeed: 2 user (2 userName), 3 content, 6 color
+// source: https://github.com/wbt5/real-url/blob/master/danmu/danmaku/kuaishou.py
+func (k *Kuaishou) encode(data []byte, payloadType int) []byte {
+	w := &pbWriter{}
+	w.Int(1, int64(payloadType))
+	w.Bytes(3, data)
+	return w.Data()
+}
+
+func (k *Kuaishou) decode(raw []byte) ([]pbMessage, error) {
+	message, err := pbUnmarshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	payload := message.Bytes(3)
+	if message.Int(2) == KS_COMPRESSION_GZIP {
+		payload, err = gunzip(KUAISHOU, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var res []pbMessage
+	switch message.Int(1) {
+	case KS_SC_FEED_PUSH:
+		push, err := pbUnmarshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		res = push.Messages(5)
+	case KS_SC_ENTER_ROOM:
+		logger.Infof("room %s entered", k.RoomID)
+	case KS_SC_HEARTBEAT_ACK:
+	default:
+		logger.Debugf("kuaishou payload type %d", message.Int(1))
+	}
+	return res, nil
+}
+
+func (k *Kuaishou) authenticate(token string) error {
+	w := &pbWriter{}
+	w.String(1, token)
+	w.String(2, k.liveStreamID)
+	w.String(7, fmt.Sprintf("%016x_%d", rand.Uint64(), time.Now().UnixNano()/int64(time.Millisecond)))
+	return k.Dan.WriteMessage(websocket.BinaryMessage, k.encode(w.Data(), KS_CS_ENTER_ROOM))
+}
+
+func (k *Kuaishou) heartBeat(ctx context.Context) error {
+	defer logger.Infof("heartbeat of room %s exited", k.RoomID)
+	ticker := time.NewTicker(time.Second * 20)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w := &pbWriter{}
+			w.Int(1, time.Now().UnixNano()/int64(time.Millisecond))
+			err := k.Dan.WriteMessage(websocket.BinaryMessage, k.encode(w.Data(), KS_CS_HEARTBEAT))
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// kuaishouDanmaku converts WebCommentFeed to danmaku, user: 1 principalId, 2 userName
+func kuaishouDanmaku(comment pbMessage) *Danmaku {
+	color := comment.String(6)
+	if color == "" {
+		color = "#ffffff"
+	}
+	user := comment.Message(2)
+	return &Danmaku{
+		Kind:      KIND_CHAT,
+		Text:      comment.String(3),
+		Color:     color,
+		Type:      DANMAKU_SCROLL,
+		UID:       user.String(1),
+		Name:      user.String(2),
+		Timestamp: nowMillis(),
+	}
+}
+
+// handle converts comments of a frame to danmaku
+func (k *Kuaishou) handle(raw []byte) ([]*Danmaku, error) {
+	res, err := k.decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	var danmakus []*Danmaku
+	for _, comment := range res {
+		danmakus = append(danmakus, kuaishouDanmaku(comment))
+	}
+	return danmakus, nil
+}
+
+func (k *Kuaishou) dial() error {
+	// websocket token and servers
+	res, err := util.Request("GET", fmt.Sprintf(KuaishouWebsocketUrl, k.liveStreamID), "", map[string]string{
+		"User-Agent": KuaishouUserAgent,
+		"Cookie":     k.cookie,
+		"Referer":    fmt.Sprintf(KuaishouRoomUrl, k.RoomID),
+	})
+	if err != nil {
+		return err
+	}
+	info := gjson.ParseBytes(res).Get("data")
+	token := info.Get("token").String()
+	server := info.Get("websocketUrls.0").String()
+	if token == "" || server == "" {
+		return errors.New(fmt.Sprintf("websocket info of room %s not found", k.RoomID))
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(server, http.Header{
+		"User-Agent": []string{KuaishouUserAgent},
+	})
+	if err != nil {
+		return err
+	}
+	logger.Infof("connect to danmaku %s", k.RoomID)
+	k.Dan = conn
+	err = k.authenticate(token)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (k *Kuaishou) serve(ctx context.Context) error {
+	return serveConn(ctx, k.Dan, k.listen(k.Dan, k.handle), k.heartBeat)
+}
@@ -0,0 +1,125 @@
+package platform
+
+import (
+	"reflect"
+	"testing"
+)
+
+// room pages in testdata are reconstructed from the layout of kuaishou room pages,
+// they keep the fields read by kuaishouRoom and the undefined values of js
+func TestKuaishouRoom(t *testing.T) {
+	const (
+		best   = "https://tx-flv.kwai.net/gifshow/x8bf9UMmOFk.flv?txSecret=0123&txTime=65000000"
+		hd2000 = "https://tx-flv.kwai.net/gifshow/x8bf9UMmOFk_hd2000.flv?txSecret=0123&txTime=65000000"
+	)
+	qualities := []Quality{
+		{Quality: 2000, Description: "高清"},
+		{Quality: 4000, Description: "超清"},
+		{Quality: 8000, Description: "蓝光 8M"},
+	}
+	tests := []struct {
+		page      string
+		quality   uint
+		status    uint
+		stream    string
+		link      string
+		qualities []Quality
+	}{
+		{page: "kuaishou_offline.html"},
+		{page: "kuaishou_live.html", status: 1, stream: "x8bf9UMmOFk", link: best, qualities: qualities},
+		{page: "kuaishou_live.html", quality: 2000, status: 1, stream: "x8bf9UMmOFk", link: hd2000, qualities: qualities},
+		// unknown quality falls back to the highest one
+		{page: "kuaishou_live.html", quality: 1234, status: 1, stream: "x8bf9UMmOFk", link: best, qualities: qualities},
+	}
+	for _, tt := range tests {
+		room, err := kuaishouRoom("test", fixture(t, tt.page))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.page, err)
+		}
+		if room.RoomID != "3xtest" || room.liveStreamID != tt.stream {
+			t.Errorf("%s: room %s stream %s", tt.page, room.RoomID, room.liveStreamID)
+		}
+		room.Quality = tt.quality
+		info, err := room.GetLiveInfo()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.page, err)
+		}
+		if info.Status != tt.status || info.Link != tt.link {
+			t.Errorf("%s: status %d link %s, want %d %s", tt.page, info.Status, info.Link, tt.status, tt.link)
+		}
+		if !reflect.DeepEqual(info.Qualities, tt.qualities) {
+			t.Errorf("%s: qualities %+v, want %+v", tt.page, info.Qualities, tt.qualities)
+		}
+	}
+}
+
+func TestKuaishouRoomNotFound(t *testing.T) {
+	_, err := kuaishouRoom("test", []byte(`<script>window.__INITIAL_STATE__={"liveroom":{"playList":[]}};</script>`))
+	if err == nil {
+		t.Fatal("room found in page without play list")
+	}
+}
+
+// kuaishouFeedPush makes a SCWebFeedPush frame with a comment of every text
+func kuaishouFeedPush(compression int64, texts ...string) []byte {
+	push := &pbWriter{}
+	for _, text := range texts {
+		push.Message(5, func(w *pbWriter) {
+			w.String(1, "comment")
+			w.Message(2, func(w *pbWriter) {
+				w.String(1, "3xuser")
+				w.String(2, "user")
+			})
+			w.String(3, text)
+			w.String(6, "#FF8BB4")
+		})
+	}
+	payload := push.Data()
+	if compression == KS_COMPRESSION_GZIP {
+		payload = gzipBody(payload)
+	}
+	w := &pbWriter{}
+	w.Int(1, KS_SC_FEED_PUSH)
+	w.Int(2, compression)
+	w.Bytes(3, payload)
+	return w.Data()
+}
+
+func TestKuaishouDecode(t *testing.T) {
+	ack := (&Kuaishou{}).encode(nil, KS_SC_HEARTBEAT_ACK)
+	enter := (&Kuaishou{}).encode(nil, KS_SC_ENTER_ROOM)
+	broken := &pbWriter{}
+	broken.Int(1, KS_SC_FEED_PUSH)
+	broken.Int(2, KS_COMPRESSION_GZIP)
+	broken.Bytes(3, []byte("not gzip"))
+	tests := []struct {
+		name  string
+		frame []byte
+		texts []string
+		err   bool
+	}{
+		{name: "feed push", frame: kuaishouFeedPush(1, "hello", "world"), texts: []string{"hello", "world"}},
+		{name: "gzip feed push", frame: kuaishouFeedPush(KS_COMPRESSION_GZIP, "hello"), texts: []string{"hello"}},
+		{name: "heartbeat ack", frame: ack},
+		{name: "enter room", frame: enter},
+		{name: "broken gzip", frame: broken.Data(), err: true},
+	}
+	for _, tt := range tests {
+		res, err := (&Kuaishou{}).decode(tt.frame)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		var texts []string
+		for _, comment := range res {
+			danmaku := kuaishouDanmaku(comment)
+			if danmaku.UID != "3xuser" || danmaku.Name != "user" || danmaku.Color != "#FF8BB4" {
+				t.Errorf("%s: got danmaku %+v", tt.name, danmaku)
+			}
+			texts = append(texts, danmaku.Text)
+		}
+		if !reflect.DeepEqual(texts, tt.texts) {
+			t.Errorf("%s: got %q, want %q", tt.name, texts, tt.texts)
+		}
+	}
+}
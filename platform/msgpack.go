@@ -0,0 +1,321 @@
+package platform
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// minimal msgpack codec used by netease cc, maps are decoded to mpMap whose keys
+// are int64 or string, integers are int64, strings and binaries are string,
+// ext values are skipped and decoded to nil
+// source: https://github.com/msgpack/msgpack/blob/master/spec.md
+var ErrMsgpackEOF = errors.New("msgpack: unexpected end of data")
+
+type mpMap map[interface{}]interface{}
+
+// Get finds a value by int or string key
+func (m mpMap) Get(key interface{}) interface{} {
+	if k, ok := key.(int); ok {
+		key = int64(k)
+	}
+	return m[key]
+}
+
+func (m mpMap) String(key interface{}) string {
+	v, _ := m.Get(key).(string)
+	return v
+}
+
+func (m mpMap) Int(key interface{}) int64 {
+	v, _ := m.Get(key).(int64)
+	return v
+}
+
+func (m mpMap) Map(key interface{}) mpMap {
+	v, _ := m.Get(key).(mpMap)
+	if v == nil {
+		return mpMap{}
+	}
+	return v
+}
+
+func (m mpMap) List(key interface{}) []interface{} {
+	v, _ := m.Get(key).([]interface{})
+	return v
+}
+
+func mpMarshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := mpWrite(buf, v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func mpWrite(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case int:
+		mpWriteInt(buf, int64(v))
+	case int64:
+		mpWriteInt(buf, v)
+	case float64:
+		buf.WriteByte(0xcb)
+		_ = binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case string:
+		l := len(v)
+		switch {
+		case l < 32:
+			buf.WriteByte(0xa0 | byte(l))
+		case l <= math.MaxUint8:
+			buf.WriteByte(0xd9)
+			buf.WriteByte(byte(l))
+		case l <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			_ = binary.Write(buf, binary.BigEndian, uint16(l))
+		default:
+			buf.WriteByte(0xdb)
+			_ = binary.Write(buf, binary.BigEndian, uint32(l))
+		}
+		buf.WriteString(v)
+	case []interface{}:
+		mpWriteLength(buf, len(v), 0x90, 0xdc)
+		for _, item := range v {
+			if err := mpWrite(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		mpWriteLength(buf, len(v), 0x80, 0xde)
+		// sort keys so the output is stable
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			_ = mpWrite(buf, k)
+			if err := mpWrite(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New(fmt.Sprintf("msgpack: unsupported type %T", v))
+	}
+	return nil
+}
+
+func mpWriteInt(buf *bytes.Buffer, v int64) {
+	switch {
+	case v >= 0 && v < 128:
+		buf.WriteByte(byte(v))
+	case v < 0 && v >= -32:
+		buf.WriteByte(byte(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		_ = binary.Write(buf, binary.BigEndian, int32(v))
+	default:
+		buf.WriteByte(0xd3)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	}
+}
+
+// mpWriteLength writes array or map length, fix formats hold up to 15 items
+func mpWriteLength(buf *bytes.Buffer, l int, fix, long byte) {
+	switch {
+	case l < 16:
+		buf.WriteByte(fix | byte(l))
+	case l <= math.MaxUint16:
+		buf.WriteByte(long)
+		_ = binary.Write(buf, binary.BigEndian, uint16(l))
+	default:
+		buf.WriteByte(long + 1)
+		_ = binary.Write(buf, binary.BigEndian, uint32(l))
+	}
+}
+
+type mpReader struct {
+	data   []byte
+	offset int
+}
+
+func (r *mpReader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data)-r.offset {
+		return nil, ErrMsgpackEOF
+	}
+	b := r.data[r.offset : r.offset+n]
+	r.offset += n
+	return b, nil
+}
+
+// uint reads a big endian unsigned integer of n bytes
+func (r *mpReader) uint(n int) (uint64, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (r *mpReader) raw(n int) (interface{}, error) {
+	l, err := r.uint(n)
+	if err != nil {
+		return nil, err
+	}
+	if l > uint64(len(r.data)) {
+		return nil, ErrMsgpackEOF
+	}
+	b, err := r.next(int(l))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (r *mpReader) array(n int) ([]interface{}, error) {
+	if n > len(r.data)-r.offset {
+		return nil, ErrMsgpackEOF
+	}
+	l := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := r.value()
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, v)
+	}
+	return l, nil
+}
+
+func (r *mpReader) mapping(n int) (mpMap, error) {
+	if n > len(r.data)-r.offset {
+		return nil, ErrMsgpackEOF
+	}
+	m := mpMap{}
+	for i := 0; i < n; i++ {
+		k, err := r.value()
+		if err != nil {
+			return nil, err
+		}
+		v, err := r.value()
+		if err != nil {
+			return nil, err
+		}
+		switch k.(type) {
+		case int64, string:
+			m[k] = v
+		default:
+			m[fmt.Sprint(k)] = v
+		}
+	}
+	return m, nil
+}
+
+func (r *mpReader) value() (interface{}, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	t := b[0]
+	switch {
+	case t <= 0x7f:
+		return int64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t&0xf0 == 0x80:
+		return r.mapping(int(t & 0x0f))
+	case t&0xf0 == 0x90:
+		return r.array(int(t & 0x0f))
+	case t&0xe0 == 0xa0:
+		b, err := r.next(int(t & 0x1f))
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	}
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xd9:
+		return r.raw(1)
+	case 0xc5, 0xda:
+		return r.raw(2)
+	case 0xc6, 0xdb:
+		return r.raw(4)
+	case 0xca:
+		v, err := r.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := r.uint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := r.uint(1 << (t - 0xcc))
+		return int64(v), err
+	case 0xd0:
+		v, err := r.uint(1)
+		return int64(int8(v)), err
+	case 0xd1:
+		v, err := r.uint(2)
+		return int64(int16(v)), err
+	case 0xd2:
+		v, err := r.uint(4)
+		return int64(int32(v)), err
+	case 0xd3:
+		v, err := r.uint(8)
+		return int64(v), err
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.array(int(n))
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.mapping(int(n))
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		// fixext, a type byte then 1 to 16 bytes
+		_, err := r.next(1 + 1<<(t-0xd4))
+		return nil, err
+	case 0xc7, 0xc8, 0xc9:
+		// ext, a length of 1, 2 or 4 bytes then a type byte
+		l, err := r.uint(1 << (t - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		if l > uint64(len(r.data)) {
+			return nil, ErrMsgpackEOF
+		}
+		_, err = r.next(int(l) + 1)
+		return nil, err
+	default:
+		return nil, errors.New(fmt.Sprintf("msgpack: unsupported format 0x%x", t))
+	}
+}
+
+func mpUnmarshal(data []byte) (interface{}, error) {
+	r := &mpReader{data: data}
+	return r.value()
+}
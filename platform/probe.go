@@ -0,0 +1,103 @@
+package platform
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// links taking longer are failed
+const ProbeTimeout = 3 * time.Second
+
+var probeClient = http.Client{
+	Timeout: ProbeTimeout,
+}
+
+// ProbeLinks measures connect time and first byte latency of links at the same time, links
+// are sorted by first byte latency and failed ones are the last
+func ProbeLinks(links []Link) {
+	var wg sync.WaitGroup
+	for i := range links {
+		wg.Add(1)
+		go func(link *Link) {
+			defer wg.Done()
+			probe(link)
+		}(&links[i])
+	}
+	wg.Wait()
+	sort.SliceStable(links, func(i, j int) bool {
+		if (links[i].Error == "") != (links[j].Error == "") {
+			return links[i].Error == ""
+		}
+		return links[i].FirstByte < links[j].FirstByte
+	})
+}
+
+// probe requests link and stops after the first byte, streams are never read
+func probe(link *Link) {
+	ctx, cancel := context.WithTimeout(context.Background(), ProbeTimeout)
+	defer cancel()
+	start := time.Now()
+	// dialing may race over several addresses, the first connection is kept
+	var mu sync.Mutex
+	var connectStart, connectDone, handshakeDone time.Time
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			if connectStart.IsZero() {
+				connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil && connectDone.IsZero() {
+				connectDone = time.Now()
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if handshakeDone.IsZero() {
+				handshakeDone = time.Now()
+			}
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), "GET", link.URL, nil)
+	if err != nil {
+		link.Error = err.Error()
+		return
+	}
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		link.Error = err.Error()
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		link.Error = resp.Status
+		return
+	}
+	// the first byte of body, headers may be sent before the stream is ready
+	n, err := resp.Body.Read(make([]byte, 1))
+	if n == 0 {
+		link.Error = fmt.Sprintf("no stream: %v", err)
+		return
+	}
+	// connect time includes tls handshake, it's empty if the connection is reused
+	mu.Lock()
+	defer mu.Unlock()
+	if !handshakeDone.IsZero() {
+		connectDone = handshakeDone
+	}
+	if !connectStart.IsZero() && !connectDone.IsZero() {
+		link.Connect = connectDone.Sub(connectStart).Milliseconds()
+	}
+	link.FirstByte = time.Since(start).Milliseconds()
+}
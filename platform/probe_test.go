@@ -0,0 +1,67 @@
+package platform
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProbeLinks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow.flv":
+			time.Sleep(100 * time.Millisecond)
+		case "/empty.flv":
+			// headers without stream
+			return
+		case "/live.flv":
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("FLV"))
+	}))
+	defer server.Close()
+	links := []Link{
+		newLink(server.URL+"/missing.flv", ""),
+		newLink(server.URL+"/slow.flv", ""),
+		newLink(server.URL+"/empty.flv", ""),
+		newLink(server.URL+"/live.flv", ""),
+		newLink("http://127.0.0.1:1/live.flv", ""),
+	}
+	ProbeLinks(links)
+	if links[0].URL != server.URL+"/live.flv" || links[1].URL != server.URL+"/slow.flv" {
+		t.Fatalf("links not ranked by first byte %+v", links)
+	}
+	for _, link := range links[:2] {
+		if link.Error != "" {
+			t.Errorf("%s: error %s", link.URL, link.Error)
+		}
+	}
+	if links[1].FirstByte < 100 || links[1].FirstByte < links[0].FirstByte {
+		t.Errorf("first byte %d of slow link", links[1].FirstByte)
+	}
+	for _, link := range links[2:] {
+		if link.Error == "" || link.FirstByte != 0 {
+			t.Errorf("%s: failed link got %+v", link.URL, link)
+		}
+	}
+}
+
+func TestProbeTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("FLV"))
+	}))
+	defer server.Close()
+	client := probeClient
+	probeClient = *server.Client()
+	defer func() {
+		probeClient = client
+	}()
+	link := newLink(server.URL+"/live.flv", "")
+	probe(&link)
+	if link.Error != "" || link.Connect < 0 || link.Connect > link.FirstByte {
+		t.Errorf("got %+v", link)
+	}
+}
@@ -0,0 +1,182 @@
+package platform
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// minimal protobuf wire format codec, messages are decoded without schema and
+// fields are read by number, so only the fields we need are described in code
+// source: https://developers.google.com/protocol-buffers/docs/encoding
+const (
+	PB_VARINT  = 0
+	PB_FIXED64 = 1
+	PB_BYTES   = 2
+	PB_FIXED32 = 5
+)
+
+var ErrPbEOF = errors.New("protobuf: unexpected end of data")
+
+// pbMessage holds all values of each field, repeated fields have multi values.
+// varint and fixed values are uint64, length delimited values are []byte
+type pbMessage map[int][]interface{}
+
+func (m pbMessage) Uint(field int) uint64 {
+	values := m[field]
+	if len(values) == 0 {
+		return 0
+	}
+	v, _ := values[len(values)-1].(uint64)
+	return v
+}
+
+func (m pbMessage) Int(field int) int64 {
+	return int64(m.Uint(field))
+}
+
+func (m pbMessage) Bool(field int) bool {
+	return m.Uint(field) != 0
+}
+
+func (m pbMessage) Bytes(field int) []byte {
+	values := m[field]
+	if len(values) == 0 {
+		return nil
+	}
+	v, _ := values[len(values)-1].([]byte)
+	return v
+}
+
+func (m pbMessage) String(field int) string {
+	return string(m.Bytes(field))
+}
+
+// Message decodes an embedded message, invalid or missing messages are empty
+func (m pbMessage) Message(field int) pbMessage {
+	message, err := pbUnmarshal(m.Bytes(field))
+	if err != nil {
+		return pbMessage{}
+	}
+	return message
+}
+
+// Messages decodes a repeated embedded message
+func (m pbMessage) Messages(field int) []pbMessage {
+	var res []pbMessage
+	for _, v := range m[field] {
+		b, _ := v.([]byte)
+		message, err := pbUnmarshal(b)
+		if err != nil {
+			continue
+		}
+		res = append(res, message)
+	}
+	return res
+}
+
+func pbUnmarshal(data []byte) (pbMessage, error) {
+	m := pbMessage{}
+	for offset := 0; offset < len(data); {
+		key, n := binary.Uvarint(data[offset:])
+		if n <= 0 {
+			return nil, ErrPbEOF
+		}
+		offset += n
+		field, wireType := int(key>>3), key&0x7
+		switch wireType {
+		case PB_VARINT:
+			v, n := binary.Uvarint(data[offset:])
+			if n <= 0 {
+				return nil, ErrPbEOF
+			}
+			offset += n
+			m[field] = append(m[field], v)
+		case PB_FIXED64:
+			if len(data)-offset < 8 {
+				return nil, ErrPbEOF
+			}
+			m[field] = append(m[field], binary.LittleEndian.Uint64(data[offset:]))
+			offset += 8
+		case PB_BYTES:
+			l, n := binary.Uvarint(data[offset:])
+			if n <= 0 {
+				return nil, ErrPbEOF
+			}
+			offset += n
+			if l > uint64(len(data)-offset) {
+				return nil, ErrPbEOF
+			}
+			m[field] = append(m[field], data[offset:offset+int(l)])
+			offset += int(l)
+		case PB_FIXED32:
+			if len(data)-offset < 4 {
+				return nil, ErrPbEOF
+			}
+			m[field] = append(m[field], uint64(binary.LittleEndian.Uint32(data[offset:])))
+			offset += 4
+		default:
+			return nil, errors.New(fmt.Sprintf("protobuf: unsupported wire type %d", wireType))
+		}
+	}
+	return m, nil
+}
+
+type pbWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *pbWriter) Data() []byte {
+	return w.buf.Bytes()
+}
+
+func (w *pbWriter) key(field int, wireType uint64) {
+	w.varint(uint64(field)<<3 | wireType)
+}
+
+func (w *pbWriter) varint(v uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	w.buf.Write(b[:binary.PutUvarint(b, v)])
+}
+
+// Uint writes a varint field, zero values are omitted like proto3 does
+func (w *pbWriter) Uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	w.key(field, PB_VARINT)
+	w.varint(v)
+}
+
+func (w *pbWriter) Int(field int, v int64) {
+	w.Uint(field, uint64(v))
+}
+
+func (w *pbWriter) Bool(field int, v bool) {
+	if v {
+		w.Uint(field, 1)
+	}
+}
+
+func (w *pbWriter) Bytes(field int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	w.key(field, PB_BYTES)
+	w.varint(uint64(len(v)))
+	w.buf.Write(v)
+}
+
+func (w *pbWriter) String(field int, v string) {
+	w.Bytes(field, []byte(v))
+}
+
+// Message writes an embedded message, fields are written by f
+func (w *pbWriter) Message(field int, f func(w *pbWriter)) {
+	message := &pbWriter{}
+	f(message)
+	w.key(field, PB_BYTES)
+	w.varint(uint64(message.buf.Len()))
+	w.buf.Write(message.Data())
+}
@@ -0,0 +1,100 @@
+package platform
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"math/rand"
+	"time"
+)
+
+// vars so that tests can shorten them
+var (
+	ReconnectMinDelay = time.Second
+	ReconnectMaxDelay = time.Minute
+	// the room is closed after failed attempts in a row
+	ReconnectMaxAttempts = 10
+)
+
+// upstream is a danmaku connection which can be redialed
+type upstream interface {
+	// dial connects and authenticates a new connection
+	dial() error
+	// serve runs listener and heartbeat of the connection until ctx is done or
+	// one of them fails, the connection is closed when it returns
+	serve(ctx context.Context) error
+}
+
+// serveConn runs workers of the connection until ctx is done or one of them fails,
+// the others are stopped and conn is closed to unblock the reader
+func serveConn(ctx context.Context, conn *websocket.Conn, workers ...func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	errs := make(chan error, len(workers))
+	for _, worker := range workers {
+		worker := worker
+		go func() {
+			errs <- worker(ctx)
+		}()
+	}
+	err := <-errs
+	cancel()
+	if conn != nil {
+		closeConn(conn)
+	}
+	for i := 1; i < len(workers); i++ {
+		<-errs
+	}
+	return err
+}
+
+// backoff returns the delay before attempt n counted from 0, it doubles every attempt
+// and the jitter keeps rooms broken at the same time from redialing together
+func backoff(attempt int) time.Duration {
+	delay := ReconnectMaxDelay
+	if attempt < 16 && ReconnectMinDelay<<uint(attempt) < ReconnectMaxDelay {
+		delay = ReconnectMinDelay << uint(attempt)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// supervise serves upstream of room until ctx is done, a broken connection is redialed
+// with backoff while clients keep connected and get reconnecting and reconnected status
+func supervise(ctx context.Context, room Room, conn upstream, roomID string) {
+	defer logger.Infof("supervisor of room %s exited", roomID)
+	for {
+		err := conn.serve(ctx)
+		if ctx.Err() != nil || room.IsClosed() {
+			return
+		}
+		logger.Errorf("danmaku of room %s broken: %v", roomID, err)
+		room.Send(connectionDanmaku(STATUS_RECONNECTING, "弹幕连接断开，正在重连"))
+		for attempt := 0; ; attempt++ {
+			if attempt >= ReconnectMaxAttempts || room.IsClosed() {
+				room.Close()
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff(attempt)):
+			}
+			err = conn.dial()
+			if err == nil {
+				break
+			}
+			logger.Errorf("reconnect to danmaku of room %s failed: %v", roomID, err)
+		}
+		logger.Infof("reconnected to danmaku %s", roomID)
+		room.Send(connectionDanmaku(STATUS_RECONNECTED, "弹幕已重连"))
+	}
+}
+
+func connectionDanmaku(event, text string) *Danmaku {
+	return &Danmaku{
+		Kind:      KIND_STATUS,
+		Text:      text,
+		Color:     "#ffffff",
+		Type:      DANMAKU_SCROLL,
+		Timestamp: nowMillis(),
+		Status:    &LiveStatus{Event: event},
+	}
+}
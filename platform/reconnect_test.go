@@ -0,0 +1,220 @@
+package platform
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// test platform able to reconnect
+const reconnectTest Type = 1001
+
+func init() {
+	Register(&Adapter{
+		Type:         reconnectTest,
+		Name:         "reconnect-test",
+		Capabilities: Capabilities{Danmaku: true, Reconnect: true},
+		New: func(id string, quality uint, client *websocket.Conn) (Room, error) {
+			return nil, errors.New("test platform")
+		},
+	})
+}
+
+// fakeUpstream fails dial or serve with the given errors
+type fakeUpstream struct {
+	dialErr  error
+	serveErr error
+	served   chan struct{}
+}
+
+func (u *fakeUpstream) dial() error {
+	return u.dialErr
+}
+
+func (u *fakeUpstream) serve(ctx context.Context) error {
+	close(u.served)
+	return u.serveErr
+}
+
+func TestServeConnStopsWorkers(t *testing.T) {
+	broken := errors.New("broken")
+	stopped := make(chan struct{})
+	err := serveConn(context.Background(), nil,
+		func(ctx context.Context) error {
+			return broken
+		},
+		func(ctx context.Context) error {
+			<-ctx.Done()
+			close(stopped)
+			return nil
+		})
+	if err != broken {
+		t.Fatalf("got %v, want %v", err, broken)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("worker not stopped")
+	}
+}
+
+func TestConnectClosesRoom(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream *fakeUpstream
+	}{
+		{"dial", &fakeUpstream{dialErr: errors.New("refused"), served: make(chan struct{})}},
+		{"serve", &fakeUpstream{serveErr: errors.New("broken"), served: make(chan struct{})}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// test rooms can't reconnect, they are closed once upstream fails
+			room := newTestRoom(tt.name)().(*testRoom)
+			room.connect(tt.upstream)
+			deadline := time.Now().Add(time.Second * 5)
+			for !room.IsClosed() {
+				if time.Now().After(deadline) {
+					t.Fatal("room not closed")
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+			if tt.upstream.dialErr != nil {
+				select {
+				case <-tt.upstream.served:
+					t.Fatal("upstream served after dial failed")
+				default:
+				}
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 40; attempt++ {
+		max := ReconnectMaxDelay
+		if attempt < 16 && ReconnectMinDelay<<uint(attempt) < max {
+			max = ReconnectMinDelay << uint(attempt)
+		}
+		for i := 0; i < 20; i++ {
+			if delay := backoff(attempt); delay < max/2 || delay > max {
+				t.Fatalf("attempt %d: delay %v out of [%v, %v]", attempt, delay, max/2, max)
+			}
+		}
+	}
+	// delays double until they are capped
+	if backoff(0) > ReconnectMinDelay || backoff(3) < 4*ReconnectMinDelay || backoff(30) < ReconnectMaxDelay/2 {
+		t.Fatal("delays don't grow")
+	}
+}
+
+// flakyUpstream fails serve once, dial fails after that if redial is false
+type flakyUpstream struct {
+	redial bool
+	dials  int32
+	serves int32
+}
+
+func (u *flakyUpstream) dial() error {
+	if atomic.AddInt32(&u.dials, 1) == 1 || u.redial {
+		return nil
+	}
+	return errors.New("refused")
+}
+
+func (u *flakyUpstream) serve(ctx context.Context) error {
+	if atomic.AddInt32(&u.serves, 1) == 1 {
+		return errors.New("broken")
+	}
+	<-ctx.Done()
+	return nil
+}
+
+type reconnectRoom struct {
+	*BaseRoom
+	upstream *flakyUpstream
+}
+
+func (r *reconnectRoom) GetLiveInfo() (*Platform, error) {
+	return &Platform{}, nil
+}
+
+func (r *reconnectRoom) Connect() {
+	r.connect(r.upstream)
+}
+
+func shortReconnect(t *testing.T) {
+	min, max, attempts := ReconnectMinDelay, ReconnectMaxDelay, ReconnectMaxAttempts
+	ReconnectMinDelay, ReconnectMaxDelay, ReconnectMaxAttempts = time.Millisecond, time.Millisecond*4, 3
+	t.Cleanup(func() {
+		ReconnectMinDelay, ReconnectMaxDelay, ReconnectMaxAttempts = min, max, attempts
+	})
+}
+
+func readStatus(t *testing.T, client *websocket.Conn) string {
+	var danmaku Danmaku
+	_ = client.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if err := client.ReadJSON(&danmaku); err != nil {
+		t.Fatal(err)
+	}
+	if danmaku.Kind != KIND_STATUS || danmaku.Status == nil {
+		t.Fatalf("got danmaku %+v, want status", danmaku)
+	}
+	return danmaku.Status.Event
+}
+
+func TestSuperviseReconnect(t *testing.T) {
+	shortReconnect(t)
+	upstream := &flakyUpstream{redial: true}
+	url, rooms := roomServer(t, roomIndex(reconnectTest, "reconnect"), func() Room {
+		room := &reconnectRoom{upstream: upstream}
+		room.BaseRoom = newBaseRoom(reconnectTest, "reconnect", room)
+		return room
+	})
+	client := dialDanmaku(t, url)
+	room := <-rooms
+	defer room.Close()
+	if event := readStatus(t, client); event != STATUS_RECONNECTING {
+		t.Fatalf("got %s, want reconnecting", event)
+	}
+	if event := readStatus(t, client); event != STATUS_RECONNECTED {
+		t.Fatalf("got %s, want reconnected", event)
+	}
+	// the client stays in the room across the reconnection
+	if room.IsClosed() || room.GetClients().Len() != 1 {
+		t.Fatalf("room closed %v with %d clients", room.IsClosed(), room.GetClients().Len())
+	}
+	if dials := atomic.LoadInt32(&upstream.dials); dials != 2 {
+		t.Fatalf("dialed %d times, want 2", dials)
+	}
+}
+
+func TestSuperviseGiveUp(t *testing.T) {
+	shortReconnect(t)
+	upstream := &flakyUpstream{}
+	url, rooms := roomServer(t, roomIndex(reconnectTest, "give-up"), func() Room {
+		room := &reconnectRoom{upstream: upstream}
+		room.BaseRoom = newBaseRoom(reconnectTest, "give-up", room)
+		return room
+	})
+	client := dialDanmaku(t, url)
+	room := <-rooms
+	if event := readStatus(t, client); event != STATUS_RECONNECTING {
+		t.Fatalf("got %s, want reconnecting", event)
+	}
+	// the client is closed with the room after all attempts failed
+	_ = client.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, _, err := client.ReadMessage(); err == nil {
+		t.Fatal("got message after reconnecting")
+	}
+	if !room.IsClosed() {
+		t.Fatal("room not closed")
+	}
+	// the first dial and the failed attempts
+	if dials := atomic.LoadInt32(&upstream.dials); dials != int32(1+ReconnectMaxAttempts) {
+		t.Fatalf("dialed %d times, want %d", dials, 1+ReconnectMaxAttempts)
+	}
+}
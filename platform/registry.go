@@ -0,0 +1,123 @@
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Type is the id of a platform, it's a part of the api so ids of platforms never change
+type Type uint32
+
+// Capabilities tells clients what a platform supports
+type Capabilities struct {
+	Danmaku bool `json:"danmaku"`
+	// danmaku connection is redialed when broken
+	Reconnect bool `json:"reconnect"`
+	// popularity or online stats are sent
+	Stats bool `json:"stats"`
+	// original messages can be sent with danmaku
+	Raw bool `json:"raw"`
+	// protocol, format and codec of stream can be chosen
+	Streams bool `json:"streams"`
+}
+
+// Adapter is a platform registered by its own file, adding a platform needs no change
+// of the shared code
+type Adapter struct {
+	Type Type `json:"type"`
+	// lower case name like "bilibili"
+	Name         string       `json:"name"`
+	Capabilities Capabilities `json:"capabilities"`
+	// URL matches live room urls without scheme like "live.bilibili.com/1", the first
+	// group not empty is the room id
+	URL *regexp.Regexp `json:"-"`
+	// ids matched by URL which are pages rather than rooms like "directory", ids ending
+	// with "*" are prefixes
+	Reserved []string `json:"-"`
+	// hosts of short links redirecting to live rooms
+	ShortHosts []string `json:"-"`
+	// New returns the room for live info if client is nil, otherwise client joins the
+	// danmaku room, room ids of platforms may differ from id
+	New func(id string, quality uint, client *websocket.Conn) (Room, error) `json:"-"`
+}
+
+// MatchURL returns the room id in url without scheme, false if url isn't a room of the platform
+func (a *Adapter) MatchURL(url string) (string, bool) {
+	if a.URL == nil {
+		return "", false
+	}
+	r := a.URL.FindStringSubmatch(url)
+	for i := 1; i < len(r); i++ {
+		if r[i] != "" {
+			return r[i], !a.reserved(r[i])
+		}
+	}
+	return "", false
+}
+
+func (a *Adapter) reserved(id string) bool {
+	id = strings.ToLower(id)
+	for _, reserved := range a.Reserved {
+		if strings.HasSuffix(reserved, "*") && strings.HasPrefix(id, strings.TrimSuffix(reserved, "*")) ||
+			id == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	adapters       = map[Type]*Adapter{}
+	adaptersByName = map[string]*Adapter{}
+)
+
+// Register registers a platform, it's called by init of platforms and panics if the
+// type or name is registered twice
+func Register(adapter *Adapter) {
+	if adapter.New == nil {
+		panic(fmt.Sprintf("platform %s registered without New", adapter.Name))
+	}
+	name := strings.ToLower(adapter.Name)
+	if _, ok := adapters[adapter.Type]; ok {
+		panic(fmt.Sprintf("platform %d registered twice", adapter.Type))
+	}
+	if _, ok := adaptersByName[name]; ok {
+		panic(fmt.Sprintf("platform %s registered twice", name))
+	}
+	adapters[adapter.Type] = adapter
+	adaptersByName[name] = adapter
+}
+
+// Lookup returns the platform of type
+func Lookup(platform Type) (*Adapter, error) {
+	adapter, ok := adapters[platform]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("platform %d not found", platform))
+	}
+	return adapter, nil
+}
+
+// LookupName returns the platform of name, it's case insensitive
+func LookupName(name string) (*Adapter, error) {
+	adapter, ok := adaptersByName[strings.ToLower(name)]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("platform %s not found", name))
+	}
+	return adapter, nil
+}
+
+// Adapters returns all platforms ordered by type
+func Adapters() []*Adapter {
+	list := make([]*Adapter, 0, len(adapters))
+	for _, adapter := range adapters {
+		list = append(list, adapter)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Type < list[j].Type
+	})
+	return list
+}
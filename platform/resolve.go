@@ -0,0 +1,132 @@
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"live/util"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Resolved is the platform and room id of a live room url
+type Resolved struct {
+	Type Type   `json:"type"`
+	Name string `json:"name"`
+	// room id used in urls of the platform, it's the one to request live info and danmaku
+	RoomID string `json:"room_id"`
+}
+
+// IsURL tells whether a room id is a live room url, room ids have no "/" or "."
+func IsURL(id string) bool {
+	return strings.ContainsAny(id, "/.")
+}
+
+// Resolve returns platform and room id of a pasted live room url like "live.bilibili.com/1",
+// h5 urls of mobile and short links are resolved too
+func Resolve(link string) (*Resolved, error) {
+	u, err := parseLink(link)
+	if err != nil {
+		return nil, err
+	}
+	if resolved, ok := matchURL(u); ok {
+		return resolved, nil
+	}
+	// short links are only followed for known hosts
+	for _, adapter := range Adapters() {
+		for _, host := range adapter.ShortHosts {
+			if u.Host != host {
+				continue
+			}
+			location, err := util.Location(u.String(), nil)
+			if err != nil {
+				return nil, err
+			}
+			u, err = parseLink(location)
+			if err != nil {
+				return nil, err
+			}
+			if resolved, ok := matchURL(u); ok {
+				return resolved, nil
+			}
+			return nil, errors.New(fmt.Sprintf("short link %s redirected to %s which is not a live room", link, location))
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("no platform matches %s", link))
+}
+
+// parseLink parses url with or without scheme, host is lower cased
+func parseLink(link string) (*url.URL, error) {
+	link = strings.TrimSpace(link)
+	if !strings.Contains(link, "://") {
+		link = "https://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	u.Host = strings.ToLower(u.Host)
+	return u, nil
+}
+
+func matchURL(u *url.URL) (*Resolved, bool) {
+	link := u.Host + u.EscapedPath()
+	if u.RawQuery != "" {
+		link += "?" + u.RawQuery
+	}
+	for _, adapter := range Adapters() {
+		if id, ok := adapter.MatchURL(link); ok {
+			return &Resolved{
+				Type:   adapter.Type,
+				Name:   adapter.Name,
+				RoomID: id,
+			}, true
+		}
+	}
+	return nil, false
+}
+
+// ParseType returns platform of a type number like "0" or a name like "bilibili"
+func ParseType(platform string) (Type, error) {
+	if n, err := strconv.ParseUint(platform, 10, 32); err == nil {
+		adapter, err := Lookup(Type(n))
+		if err != nil {
+			return 0, err
+		}
+		return adapter.Type, nil
+	}
+	adapter, err := LookupName(platform)
+	if err != nil {
+		return 0, err
+	}
+	return adapter.Type, nil
+}
+
+// ResolveRoom returns platform and room id of request params, platform may be empty if
+// room id is a url and a url of another platform is refused
+func ResolveRoom(platform, roomID string) (Type, string, error) {
+	if !IsURL(roomID) {
+		if platform == "" {
+			return 0, "", errors.New("platform is required for room id")
+		}
+		t, err := ParseType(platform)
+		if err != nil {
+			return 0, "", err
+		}
+		return t, roomID, nil
+	}
+	resolved, err := Resolve(roomID)
+	if err != nil {
+		return 0, "", err
+	}
+	if platform != "" {
+		t, err := ParseType(platform)
+		if err != nil {
+			return 0, "", err
+		}
+		if t != resolved.Type {
+			return 0, "", errors.New(fmt.Sprintf("%s is not a room of platform %s", roomID, platform))
+		}
+	}
+	return resolved.Type, resolved.RoomID, nil
+}
@@ -0,0 +1,86 @@
+package platform
+
+import "testing"
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		link     string
+		platform Type
+		roomID   string
+	}{
+		{"live.bilibili.com/123", BILIBILI, "123"},
+		{"https://live.bilibili.com/h5/456?from=share", BILIBILI, "456"},
+		{"LIVE.BILIBILI.COM/77", BILIBILI, "77"},
+		{"www.douyu.com/topic/xyz?rid=9999", DOUYU, "9999"},
+		{"https://m.douyu.com/888", DOUYU, "888"},
+		{"https://www.douyu.com/lpl", DOUYU, "lpl"},
+		{"https://www.huya.com/abc", HUYA, "abc"},
+		{"https://m.huya.com/660000", HUYA, "660000"},
+		{"https://www.twitch.tv/foo", TWITCH, "foo"},
+		{"https://www.twitch.tv/popout/foo/chat", TWITCH, "foo"},
+		{"https://live.douyin.com/123456", DOUYIN, "123456"},
+		{"live.kuaishou.com/u/a-b", KUAISHOU, "a-b"},
+		{"https://youtu.be/abcDEF", YOUTUBE, "abcDEF"},
+		{"https://www.youtube.com/watch?feature=x&v=vid1", YOUTUBE, "vid1"},
+		{"https://www.youtube.com/@Some.Handle-1", YOUTUBE, "@Some.Handle-1"},
+		{"m.youtube.com/@handle/live", YOUTUBE, "@handle"},
+		{"h5.cc.163.com/cc/361433", CC, "361433"},
+		{"m.acfun.cn/live/detail/42", ACFUN, "42"},
+	}
+	for _, test := range tests {
+		resolved, err := Resolve(test.link)
+		if err != nil {
+			t.Errorf("resolve %s: %v", test.link, err)
+			continue
+		}
+		if resolved.Type != test.platform || resolved.RoomID != test.roomID {
+			t.Errorf("resolve %s: got %d %s, want %d %s", test.link, resolved.Type, resolved.RoomID, test.platform, test.roomID)
+		}
+	}
+}
+
+func TestResolveNotRoom(t *testing.T) {
+	for _, link := range []string{
+		"https://www.huya.com/g/lol",
+		"https://www.twitch.tv/directory",
+		"https://www.twitch.tv/videos/123",
+		"https://www.douyu.com/topic/xyz",
+		"https://www.douyu.com/g_LOL",
+		"evil.com/live.bilibili.com/1",
+		"https://example.com/1",
+	} {
+		if resolved, err := Resolve(link); err == nil {
+			t.Errorf("resolve %s: got %+v, want error", link, resolved)
+		}
+	}
+}
+
+func TestResolveRoom(t *testing.T) {
+	tests := []struct {
+		platform string
+		roomID   string
+		want     Type
+		wantID   string
+		err      bool
+	}{
+		{"bilibili", "1", BILIBILI, "1", false},
+		{"1", "9999", DOUYU, "9999", false},
+		{"", "live.bilibili.com/1", BILIBILI, "1", false},
+		{"bilibili", "live.bilibili.com/1", BILIBILI, "1", false},
+		{"douyu", "live.bilibili.com/1", 0, "", true},
+		{"", "1", 0, "", true},
+		{"unknown", "1", 0, "", true},
+	}
+	for _, test := range tests {
+		platform, roomID, err := ResolveRoom(test.platform, test.roomID)
+		if test.err {
+			if err == nil {
+				t.Errorf("resolve %s %s without error", test.platform, test.roomID)
+			}
+			continue
+		}
+		if err != nil || platform != test.want || roomID != test.wantID {
+			t.Errorf("resolve %s %s: got %d %s %v", test.platform, test.roomID, platform, roomID, err)
+		}
+	}
+}
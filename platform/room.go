@@ -0,0 +1,129 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+)
+
+// BaseRoom is the fan-out and lifecycle shared by danmaku rooms, platforms embed it and
+// only implement live info and their protocol. rooms for live info have no base room
+type BaseRoom struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	Clients  *Clients
+	platform Type
+	index    string
+	// the room embedding base, it's the one registered in hub
+	room Room
+	// latest stats, only updated by platforms sending stats
+	stats roomStats
+}
+
+// newBaseRoom makes the base of room, roomID is the real room id used in index of hub
+func newBaseRoom(platform Type, roomID string, room Room) *BaseRoom {
+	base := &BaseRoom{
+		Clients:  NewClients(),
+		platform: platform,
+		index:    roomIndex(platform, roomID),
+		room:     room,
+	}
+	base.ctx, base.cancel = context.WithCancel(context.Background())
+	return base
+}
+
+// roomIndex is the index of danmaku room in hub
+func roomIndex(platform Type, roomID string) string {
+	return fmt.Sprintf("%d:%s", platform, roomID)
+}
+
+// Connect connects the room embedding base to its upstream
+func (b *BaseRoom) Connect() {
+	conn, ok := b.room.(upstream)
+	if !ok {
+		logger.Errorf("room %s has no upstream", b.index)
+		b.Close()
+		return
+	}
+	b.connect(conn)
+}
+
+// listen returns the worker reading conn until ctx is done or conn breaks, every message
+// is converted to danmaku by handle and sent to clients
+func (b *BaseRoom) listen(conn *websocket.Conn, handle func(raw []byte) ([]*Danmaku, error)) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		defer logger.Infof("listener of room %s exited", b.index)
+		for {
+			_, raw, err := conn.ReadMessage()
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			res, err := handle(raw)
+			if err != nil {
+				return err
+			}
+			logger.Debugf("room %s clients %d", b.index, b.Clients.Len())
+			for _, danmaku := range res {
+				b.Send(danmaku)
+			}
+		}
+	}
+}
+
+// connect dials upstream of the room and serves it in background, the room is closed
+// if dial fails. upstream of platforms able to reconnect is supervised, the others
+// close the room once the connection breaks
+func (b *BaseRoom) connect(conn upstream) {
+	err := conn.dial()
+	if err != nil {
+		logger.Error(err)
+		b.Close()
+		return
+	}
+	if adapter, err := Lookup(b.platform); err == nil && adapter.Capabilities.Reconnect {
+		go supervise(b.ctx, b.room, conn, b.index)
+		return
+	}
+	go func() {
+		err := conn.serve(b.ctx)
+		if err != nil && b.ctx.Err() == nil {
+			logger.Errorf("danmaku of room %s broken: %v", b.index, err)
+		}
+		b.Close()
+	}()
+}
+
+func (b *BaseRoom) GetClients() *Clients {
+	return b.Clients
+}
+
+func (b *BaseRoom) IsClosed() bool {
+	return b.Clients.IsClosed()
+}
+
+// GetStats returns nil before any stats received
+func (b *BaseRoom) GetStats() *Stats {
+	return b.stats.Get()
+}
+
+func (b *BaseRoom) Send(danmaku *Danmaku) {
+	logger.Infof("danmaku %+v", danmaku)
+	// clients failed are removed
+	if b.Clients.Broadcast(danmaku) == 0 {
+		b.Close()
+	}
+}
+
+func (b *BaseRoom) Close() {
+	// clients are closed here
+	if !b.Clients.Close() {
+		return
+	}
+	// stop goroutines of the room, danmaku websocket is closed by serve
+	b.cancel()
+	hub.Delete(b.index, b.room)
+	logger.Infof("room %s closed, rooms %d", b.index, hub.Len())
+}
@@ -0,0 +1,309 @@
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// STT serialization of douyu messages, a map is "key@=value/" pairs and a list is "item/" items,
+// nested maps and lists are serialized first and then escaped as a value, "@" is escaped
+// as "@A" and "/" as "@S". struct fields are mapped with `stt:"name"` tags
+// source: https://open.cplusplus.me/DevelopmentDocs/%E6%96%97%E9%B1%BC%E5%BC%B9%E5%B9%95%E6%9C%8D%E5%8A%A1%E5%99%A8%E7%AC%AC%E4%B8%89%E6%96%B9%E6%8E%A5%E5%85%A5%E5%8D%8F%E8%AE%AEv1.6.2.pdf
+var ErrSttInvalid = errors.New("stt: invalid data")
+
+var (
+	sttEscaper   = strings.NewReplacer("@", "@A", "/", "@S")
+	sttUnescaper = strings.NewReplacer("@A", "@", "@S", "/")
+)
+
+func sttEscape(s string) string {
+	return sttEscaper.Replace(s)
+}
+
+func sttUnescape(s string) string {
+	return sttUnescaper.Replace(s)
+}
+
+// sttMarshal serializes maps, structs, slices and scalars, the type key of maps is
+// written first since douyu requires it
+func sttMarshal(v interface{}) ([]byte, error) {
+	s, err := sttString(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+func sttString(v reflect.Value) (string, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return "", nil
+		}
+		v = v.Elem()
+	}
+	var b strings.Builder
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		if v.Bool() {
+			return "1", nil
+		}
+		return "0", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64), nil
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			item, err := sttString(v.Index(i))
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(sttEscape(item))
+			b.WriteByte('/')
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return "", errors.New(fmt.Sprintf("stt: unsupported map key %s", v.Type().Key()))
+		}
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i] == "type" || keys[j] == "type" {
+				return keys[i] == "type"
+			}
+			return keys[i] < keys[j]
+		})
+		for _, k := range keys {
+			item, err := sttString(v.MapIndex(reflect.ValueOf(k).Convert(v.Type().Key())))
+			if err != nil {
+				return "", err
+			}
+			sttWritePair(&b, k, item)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name, ok := sttField(t.Field(i))
+			if !ok {
+				continue
+			}
+			item, err := sttString(v.Field(i))
+			if err != nil {
+				return "", err
+			}
+			sttWritePair(&b, name, item)
+		}
+	default:
+		return "", errors.New(fmt.Sprintf("stt: unsupported type %s", v.Type()))
+	}
+	return b.String(), nil
+}
+
+func sttWritePair(b *strings.Builder, key, value string) {
+	b.WriteString(sttEscape(key))
+	b.WriteString("@=")
+	b.WriteString(sttEscape(value))
+	b.WriteByte('/')
+}
+
+// sttField returns the stt name of a struct field, unexported and "-" fields are skipped
+func sttField(field reflect.StructField) (string, bool) {
+	if field.PkgPath != "" {
+		return "", false
+	}
+	name := field.Tag.Get("stt")
+	if name == "-" {
+		return "", false
+	}
+	if name == "" {
+		name = field.Name
+	}
+	return name, true
+}
+
+// sttUnmarshal parses data into a *map[string]interface{} or a pointer to struct. since
+// nested values are plain escaped strings, map values are decoded as nested maps or lists
+// of maps only when they are valid ones, other values are strings. struct fields decode
+// nested values by their types, so use structs when a value may look like a map
+func sttUnmarshal(data []byte, v interface{}) error {
+	// frames of douyu end with 0
+	s := strings.TrimRight(string(data), "\x00")
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New(fmt.Sprintf("stt: unmarshal to non pointer %T", v))
+	}
+	if m, ok := v.(*map[string]interface{}); ok {
+		pairs, ok := sttPairs(s)
+		if !ok {
+			return ErrSttInvalid
+		}
+		*m = sttMapValue(pairs)
+		return nil
+	}
+	return sttSet(rv.Elem(), s)
+}
+
+// sttItems splits serialized items, the last "/" is optional. "/" is a list of one empty item
+func sttItems(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "/"), "/")
+}
+
+// sttPairs splits serialized pairs, keys and values are unescaped
+func sttPairs(s string) ([][2]string, bool) {
+	items := sttItems(s)
+	if len(items) == 0 {
+		return nil, false
+	}
+	pairs := make([][2]string, 0, len(items))
+	for _, item := range items {
+		kv := strings.SplitN(item, "@=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, false
+		}
+		pairs = append(pairs, [2]string{sttUnescape(kv[0]), sttUnescape(kv[1])})
+	}
+	return pairs, true
+}
+
+func sttMapValue(pairs [][2]string) map[string]interface{} {
+	m := make(map[string]interface{}, len(pairs))
+	for _, pair := range pairs {
+		m[pair[0]] = sttGuess(pair[1])
+	}
+	return m
+}
+
+// sttGuess decodes a value as a map, a list of maps or a string
+func sttGuess(s string) interface{} {
+	if !strings.HasSuffix(s, "/") {
+		return s
+	}
+	if pairs, ok := sttPairs(s); ok {
+		return sttMapValue(pairs)
+	}
+	items := sttItems(s)
+	if len(items) == 0 {
+		return s
+	}
+	list := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		pairs, ok := sttPairs(sttUnescape(item))
+		if !ok {
+			return s
+		}
+		list = append(list, sttMapValue(pairs))
+	}
+	return list
+}
+
+func sttSet(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return sttSet(v.Elem(), s)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return errors.New(fmt.Sprintf("stt: unsupported type %s", v.Type()))
+		}
+		v.Set(reflect.ValueOf(sttGuess(s)))
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		v.SetBool(s != "" && s != "0")
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if s == "" {
+			v.SetInt(0)
+			return nil
+		}
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if s == "" {
+			v.SetUint(0)
+			return nil
+		}
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		if s == "" {
+			v.SetFloat(0)
+			return nil
+		}
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		items := sttItems(s)
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := sttSet(slice.Index(i), sttUnescape(item)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return errors.New(fmt.Sprintf("stt: unsupported map key %s", v.Type().Key()))
+		}
+		pairs, ok := sttPairs(s)
+		if !ok && s != "" {
+			return ErrSttInvalid
+		}
+		m := reflect.MakeMapWithSize(v.Type(), len(pairs))
+		for _, pair := range pairs {
+			item := reflect.New(v.Type().Elem()).Elem()
+			if err := sttSet(item, pair[1]); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(pair[0]).Convert(v.Type().Key()), item)
+		}
+		v.Set(m)
+	case reflect.Struct:
+		pairs, ok := sttPairs(s)
+		if !ok && s != "" {
+			return ErrSttInvalid
+		}
+		fields := map[string]int{}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if name, ok := sttField(t.Field(i)); ok {
+				fields[name] = i
+			}
+		}
+		for _, pair := range pairs {
+			i, ok := fields[pair[0]]
+			if !ok {
+				continue
+			}
+			if err := sttSet(v.Field(i), pair[1]); err != nil {
+				return errors.New(fmt.Sprintf("stt: field %s: %s", pair[0], err))
+			}
+		}
+	default:
+		return errors.New(fmt.Sprintf("stt: unsupported type %s", v.Type()))
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package platform
+
+import (
+	"reflect"
+	"testing"
+)
+
+type sttInner struct {
+	Name  string `stt:"nn"`
+	Level int    `stt:"lv"`
+}
+
+type sttOuter struct {
+	Type   string            `stt:"type"`
+	RoomID uint              `stt:"rid"`
+	Admin  bool              `stt:"admin"`
+	Text   string            `stt:"txt"`
+	Inner  sttInner          `stt:"inner"`
+	List   []sttInner        `stt:"list"`
+	Items  []string          `stt:"items"`
+	Attrs  map[string]string `stt:"attrs"`
+	Skip   string            `stt:"-"`
+	hidden string
+}
+
+func TestSttStructRoundTrip(t *testing.T) {
+	tests := []sttOuter{
+		{Type: "chatmsg", RoomID: 9999, Text: "hello"},
+		{Type: "chatmsg", Admin: true, Text: "a@b/c@A@S@=//"},
+		{
+			Type:  "dgb",
+			Inner: sttInner{Name: "n@/", Level: 30},
+			List:  []sttInner{{Name: "a", Level: 1}, {Name: "b/c", Level: 2}},
+			Items: []string{"x", "", "y@=z/"},
+			Attrs: map[string]string{"k@": "v/", "type": "t"},
+		},
+		{Type: "empty", Items: []string{""}},
+	}
+	for _, test := range tests {
+		data, err := sttMarshal(test)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result sttOuter
+		if err := sttUnmarshal(append(data, 0), &result); err != nil {
+			t.Fatalf("unmarshal %q: %v", data, err)
+		}
+		if !reflect.DeepEqual(normalizeStt(test), normalizeStt(result)) {
+			t.Errorf("round trip of %q:\n got %+v\nwant %+v", data, result, test)
+		}
+	}
+}
+
+// normalizeStt treats empty and nil containers as the same, stt can't tell them apart
+func normalizeStt(v sttOuter) sttOuter {
+	if len(v.List) == 0 {
+		v.List = nil
+	}
+	if len(v.Items) == 0 {
+		v.Items = nil
+	}
+	if len(v.Attrs) == 0 {
+		v.Attrs = nil
+	}
+	return v
+}
+
+func TestSttMarshal(t *testing.T) {
+	data, err := sttMarshal(map[string]interface{}{
+		"rid":  1,
+		"type": "loginreq",
+		"txt":  "a/b@c",
+		"list": []map[string]string{{"a": "1"}, {"b": "2"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// type is the first key, nested values are escaped once per level
+	want := "type@=loginreq/list@=a@AA=1@AS@Sb@AA=2@AS@S/rid@=1/txt@=a@Sb@Ac/"
+	if string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+}
+
+func TestSttUnmarshalMap(t *testing.T) {
+	tests := []struct {
+		data string
+		want map[string]interface{}
+	}{
+		{"type@=chatmsg/txt@=hi/", map[string]interface{}{"type": "chatmsg", "txt": "hi"}},
+		// escaped values are unescaped
+		{"txt@=a@Sb@Ac/", map[string]interface{}{"txt": "a/b@c"}},
+		// a nested map
+		{"m@=a@A=1@Sb@A=2@S/", map[string]interface{}{"m": map[string]interface{}{"a": "1", "b": "2"}}},
+		// a nested list of maps
+		{"l@=a@AA=1@AS@Sb@AA=2@AS@S/", map[string]interface{}{"l": []interface{}{
+			map[string]interface{}{"a": "1"},
+			map[string]interface{}{"b": "2"},
+		}}},
+		// lists of strings are kept as strings
+		{"l@=x@Sy@S/", map[string]interface{}{"l": "x/y/"}},
+		{"l@=@S/", map[string]interface{}{"l": "/"}},
+	}
+	for _, test := range tests {
+		var result map[string]interface{}
+		if err := sttUnmarshal([]byte(test.data), &result); err != nil {
+			t.Fatalf("unmarshal %q: %v", test.data, err)
+		}
+		if !reflect.DeepEqual(result, test.want) {
+			t.Errorf("unmarshal %q: got %#v, want %#v", test.data, result, test.want)
+		}
+	}
+}
+
+func TestSttUnmarshalInvalid(t *testing.T) {
+	for _, data := range []string{"", "abc", "a@=1/b/", "@=1/"} {
+		var result map[string]interface{}
+		if err := sttUnmarshal([]byte(data), &result); err != ErrSttInvalid {
+			t.Errorf("unmarshal %q: got %v, want %v", data, err, ErrSttInvalid)
+		}
+	}
+	var result sttOuter
+	if err := sttUnmarshal([]byte("rid@=abc/"), &result); err == nil {
+		t.Error("unmarshal invalid number without error")
+	}
+}
+
+type sttCase struct {
+	Text  string            `stt:"txt"`
+	Items []string          `stt:"items"`
+	Attrs map[string]string `stt:"attrs"`
+}
+
+// TestSttEscapes round trips every combination of strings with separators and escapes
+func TestSttEscapes(t *testing.T) {
+	values := []string{"", "hello", "/", "@", "@=", "@A", "@S", "@A@S@=/", "type@=x/", "a@=b/c@=d/", "c@Sd", "中文"}
+	for _, text := range values {
+		for _, item := range values {
+			for _, value := range values {
+				v := sttCase{Text: text, Items: []string{item, value}, Attrs: map[string]string{"k" + item: value}}
+				data, err := sttMarshal(v)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var result sttCase
+				if err := sttUnmarshal(data, &result); err != nil {
+					t.Fatalf("unmarshal %q: %v", data, err)
+				}
+				if !reflect.DeepEqual(v, result) {
+					t.Fatalf("round trip of %q:\n got %#v\nwant %#v", data, result, v)
+				}
+				// maps accept everything marshaled
+				var m map[string]interface{}
+				if err := sttUnmarshal(data, &m); err != nil {
+					t.Fatalf("unmarshal %q to map: %v", data, err)
+				}
+			}
+		}
+	}
+}
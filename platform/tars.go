@@ -0,0 +1,337 @@
+package platform
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// tars (jce) serialization used by huya
+// source: https://github.com/TarsCloud/TarsJava/blob/master/core/src/main/java/com/qq/tars/protocol/tars/TarsOutputStream.java
+// every field starts with a head, the high 4 bits are the tag and the low 4 bits are the type,
+// tags larger than 14 are stored in the next byte. numbers are big endian
+const (
+	TARS_INT1        = 0
+	TARS_INT2        = 1
+	TARS_INT4        = 2
+	TARS_INT8        = 3
+	TARS_FLOAT       = 4
+	TARS_DOUBLE      = 5
+	TARS_STRING1     = 6
+	TARS_STRING4     = 7
+	TARS_MAP         = 8
+	TARS_LIST        = 9
+	TARS_STRUCT      = 10
+	TARS_STRUCT_END  = 11
+	TARS_ZERO        = 12
+	TARS_SIMPLE_LIST = 13
+)
+
+var ErrTarsEOF = errors.New("tars: unexpected end of data")
+
+// tarsStruct is a decoded struct, fields are indexed by tag
+type tarsStruct map[byte]interface{}
+
+// tarsMap keeps decoded map entries in order, keys may be any tars type
+type tarsMap []struct {
+	Key   interface{}
+	Value interface{}
+}
+
+func (s tarsStruct) Int(tag byte) int64 {
+	v, _ := s[tag].(int64)
+	return v
+}
+
+func (s tarsStruct) String(tag byte) string {
+	switch v := s[tag].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+func (s tarsStruct) Bytes(tag byte) []byte {
+	v, _ := s[tag].([]byte)
+	return v
+}
+
+func (s tarsStruct) Struct(tag byte) tarsStruct {
+	v, _ := s[tag].(tarsStruct)
+	if v == nil {
+		return tarsStruct{}
+	}
+	return v
+}
+
+type tarsWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *tarsWriter) Data() []byte {
+	return w.buf.Bytes()
+}
+
+func (w *tarsWriter) head(tag, t byte) {
+	if tag < 15 {
+		w.buf.WriteByte(tag<<4 | t)
+		return
+	}
+	w.buf.WriteByte(0xf0 | t)
+	w.buf.WriteByte(tag)
+}
+
+func (w *tarsWriter) Int(tag byte, v int64) {
+	switch {
+	case v == 0:
+		w.head(tag, TARS_ZERO)
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		w.head(tag, TARS_INT1)
+		w.buf.WriteByte(byte(v))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		w.head(tag, TARS_INT2)
+		_ = binary.Write(&w.buf, binary.BigEndian, int16(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		w.head(tag, TARS_INT4)
+		_ = binary.Write(&w.buf, binary.BigEndian, int32(v))
+	default:
+		w.head(tag, TARS_INT8)
+		_ = binary.Write(&w.buf, binary.BigEndian, v)
+	}
+}
+
+func (w *tarsWriter) Bool(tag byte, v bool) {
+	if v {
+		w.Int(tag, 1)
+		return
+	}
+	w.Int(tag, 0)
+}
+
+func (w *tarsWriter) String(tag byte, v string) {
+	if len(v) > 255 {
+		w.head(tag, TARS_STRING4)
+		_ = binary.Write(&w.buf, binary.BigEndian, uint32(len(v)))
+	} else {
+		w.head(tag, TARS_STRING1)
+		w.buf.WriteByte(byte(len(v)))
+	}
+	w.buf.WriteString(v)
+}
+
+func (w *tarsWriter) Bytes(tag byte, v []byte) {
+	w.head(tag, TARS_SIMPLE_LIST)
+	w.head(0, TARS_INT1)
+	w.Int(0, int64(len(v)))
+	w.buf.Write(v)
+}
+
+// Struct writes a nested struct, fields are written by f
+func (w *tarsWriter) Struct(tag byte, f func(w *tarsWriter)) {
+	w.head(tag, TARS_STRUCT)
+	f(w)
+	w.head(0, TARS_STRUCT_END)
+}
+
+type tarsReader struct {
+	data   []byte
+	offset int
+}
+
+func (r *tarsReader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data)-r.offset {
+		return nil, ErrTarsEOF
+	}
+	b := r.data[r.offset : r.offset+n]
+	r.offset += n
+	return b, nil
+}
+
+func (r *tarsReader) head() (byte, byte, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, 0, err
+	}
+	tag, t := b[0]>>4, b[0]&0x0f
+	if tag == 15 {
+		b, err = r.next(1)
+		if err != nil {
+			return 0, 0, err
+		}
+		tag = b[0]
+	}
+	return tag, t, nil
+}
+
+func (r *tarsReader) int() (int64, error) {
+	_, t, err := r.head()
+	if err != nil {
+		return 0, err
+	}
+	v, err := r.value(t)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := v.(int64)
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("tars: type %d is not a number", t))
+	}
+	return n, nil
+}
+
+func (r *tarsReader) value(t byte) (interface{}, error) {
+	switch t {
+	case TARS_INT1:
+		b, err := r.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return int64(int8(b[0])), nil
+	case TARS_INT2:
+		b, err := r.next(2)
+		if err != nil {
+			return nil, err
+		}
+		return int64(int16(binary.BigEndian.Uint16(b))), nil
+	case TARS_INT4:
+		b, err := r.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return int64(int32(binary.BigEndian.Uint32(b))), nil
+	case TARS_INT8:
+		b, err := r.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return int64(binary.BigEndian.Uint64(b)), nil
+	case TARS_FLOAT:
+		b, err := r.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case TARS_DOUBLE:
+		b, err := r.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case TARS_STRING1:
+		l, err := r.next(1)
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.next(int(l[0]))
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case TARS_STRING4:
+		l, err := r.next(4)
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.next(int(binary.BigEndian.Uint32(l)))
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case TARS_MAP:
+		n, err := r.int()
+		if err != nil {
+			return nil, err
+		}
+		var m tarsMap
+		for i := int64(0); i < n; i++ {
+			_, kt, err := r.head()
+			if err != nil {
+				return nil, err
+			}
+			k, err := r.value(kt)
+			if err != nil {
+				return nil, err
+			}
+			_, vt, err := r.head()
+			if err != nil {
+				return nil, err
+			}
+			v, err := r.value(vt)
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, struct {
+				Key   interface{}
+				Value interface{}
+			}{k, v})
+		}
+		return m, nil
+	case TARS_LIST:
+		n, err := r.int()
+		if err != nil {
+			return nil, err
+		}
+		var l []interface{}
+		for i := int64(0); i < n; i++ {
+			_, vt, err := r.head()
+			if err != nil {
+				return nil, err
+			}
+			v, err := r.value(vt)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+		}
+		return l, nil
+	case TARS_STRUCT:
+		return r.fields(true)
+	case TARS_ZERO:
+		return int64(0), nil
+	case TARS_SIMPLE_LIST:
+		// element head, always int1
+		if _, _, err := r.head(); err != nil {
+			return nil, err
+		}
+		n, err := r.int()
+		if err != nil {
+			return nil, err
+		}
+		return r.next(int(n))
+	default:
+		return nil, errors.New(fmt.Sprintf("tars: unknown type %d", t))
+	}
+}
+
+// fields reads fields until struct end, or the end of data for top level structs
+func (r *tarsReader) fields(nested bool) (tarsStruct, error) {
+	s := tarsStruct{}
+	for r.offset < len(r.data) {
+		tag, t, err := r.head()
+		if err != nil {
+			return nil, err
+		}
+		if t == TARS_STRUCT_END {
+			return s, nil
+		}
+		v, err := r.value(t)
+		if err != nil {
+			return nil, err
+		}
+		s[tag] = v
+	}
+	if nested {
+		return nil, ErrTarsEOF
+	}
+	return s, nil
+}
+
+// tarsUnmarshal decodes a top level struct
+func tarsUnmarshal(data []byte) (tarsStruct, error) {
+	r := &tarsReader{data: data}
+	return r.fields(false)
+}
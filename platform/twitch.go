@@ -0,0 +1,370 @@
+package platform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"live/util"
+	"math/rand"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TwitchGqlUrl   = "https://gql.twitch.tv/gql"
+	TwitchUsherUrl = "https://usher.ttvnw.net/api/channel/hls/%s.m3u8?%s"
+	// client id of twitch web player
+	TwitchClientID = "kimne78kx3ncx6brgo4mv6wki5h1ko"
+	// anonymous chat login, any justinfan nick with any password is accepted
+	TwitchNick = "justinfan%d"
+)
+
+const (
+	TwitchUserQuery  = `query($login: String!) { user(login: $login) { login stream { id } } }`
+	TwitchTokenQuery = `query($login: String!) { streamPlaybackAccessToken(channelName: $login, params: {platform: "web", playerBackend: "mediaplayer", playerType: "site"}) { value signature } }`
+)
+
+// irc server is a var so that tests can replace it with a local one
+var TwitchDanmakuUrl = "wss://irc-ws.chat.twitch.tv:443"
+
+const TWITCH Type = 3
+
+var TwitchRoomUrlRe = regexp.MustCompile(`^(?:www\.|m\.)?twitch\.tv/(?:popout/)?(\w+)`)
+
+// pages matched by room url pattern
+var TwitchReservedPaths = []string{"directory", "videos", "search", "settings", "subscriptions", "inventory", "wallet",
+	"downloads", "jobs", "p", "turbo", "friends", "messages", "login", "signup", "payments"}
+
+func init() {
+	Register(&Adapter{
+		Type:         TWITCH,
+		Name:         "twitch",
+		Capabilities: Capabilities{Danmaku: true, Raw: true},
+		URL:          TwitchRoomUrlRe,
+		Reserved:     TwitchReservedPaths,
+		New:          GetTwitchRoom,
+	})
+}
+
+type Twitch struct {
+	*BaseRoom
+	RoomID  string
+	Quality uint
+	Status  int
+	Dan     *websocket.Conn
+	// pong replies are written by heartbeat, websocket supports only one writer
+	pong chan []byte
+}
+
+func twitchGql(query string, variables map[string]interface{}) (gjson.Result, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"query":     query,
+		"variables": variables,
+	})
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	res, err := util.Request("POST", TwitchGqlUrl, string(body), map[string]string{
+		"Client-ID":    TwitchClientID,
+		"Content-Type": "application/json",
+	})
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	data := gjson.ParseBytes(res)
+	if data.Get("errors.#").Int() > 0 {
+		return gjson.Result{}, errors.New(data.Get("errors.0.message").String())
+	}
+	return data, nil
+}
+
+func GetTwitchRoom(id string, quality uint, client *websocket.Conn) (Room, error) {
+	// twitch room id is the channel login name
+	data, err := twitchGql(TwitchUserQuery, map[string]interface{}{
+		"login": strings.ToLower(id),
+	})
+	if err != nil {
+		return nil, err
+	}
+	user := data.Get("data.user")
+	if !user.IsObject() {
+		return nil, errors.New(fmt.Sprintf("room %s not found", id))
+	}
+	roomID := user.Get("login").String()
+	status := 0
+	if user.Get("stream").IsObject() {
+		status = 1
+	}
+	if client == nil {
+		return &Twitch{
+			RoomID:  roomID,
+			Quality: quality,
+			Status:  status,
+		}, nil
+	}
+	return joinRoom(roomIndex(TWITCH, roomID), func() Room {
+		room := &Twitch{
+			RoomID: roomID,
+		}
+		room.BaseRoom = newBaseRoom(TWITCH, roomID, room)
+		return room
+	}, client), nil
+}
+
+func (t *Twitch) GetLiveInfo() (*Platform, error) {
+	if t.Status != 1 {
+		return &Platform{
+			Type:           TWITCH,
+			RoomID:         t.RoomID,
+			Status:         0,
+			CurrentQuality: t.Quality,
+		}, nil
+	}
+	// playback access token is required by usher
+	data, err := twitchGql(TwitchTokenQuery, map[string]interface{}{
+		"login": t.RoomID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	token := data.Get("data.streamPlaybackAccessToken")
+	params := url.Values{}
+	params.Set("allow_source", "true")
+	params.Set("allow_audio_only", "true")
+	params.Set("fast_bread", "true")
+	params.Set("p", fmt.Sprint(rand.Intn(1000000)))
+	params.Set("sig", token.Get("signature").String())
+	params.Set("token", token.Get("value").String())
+	playlist, err := util.Request("GET", fmt.Sprintf(TwitchUsherUrl, t.RoomID, params.Encode()), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	variants := parseMasterPlaylist(playlist)
+	if len(variants) == 0 {
+		return nil, errors.New(fmt.Sprintf("no stream found in room %s", t.RoomID))
+	}
+	// quality is the bandwidth of variant, the first variant (source) is the default
+	var qualities []Quality
+	current := variants[0]
+	for _, variant := range variants {
+		qualities = append(qualities, Quality{
+			Quality:     variant.Bandwidth,
+			Description: variant.Name,
+		})
+		if uint64(t.Quality) == variant.Bandwidth {
+			current = variant
+		}
+	}
+	return &Platform{
+		Type:           TWITCH,
+		RoomID:         t.RoomID,
+		Status:         uint(t.Status),
+		CurrentQuality: uint(current.Bandwidth),
+		Link:           current.Url,
+		Qualities:      qualities,
+	}, nil
+}
+
+// twitch chat is irc over websocket, one text frame may contain multi lines
+// tags are sent before prefix when the twitch.tv/tags capability is requested
+// @color=#FF0000;display-name=Nick :nick!nick@nick.tmi.twitch.tv PRIVMSG #channel :text
+// source: https://dev.twitch.tv/docs/irc
+type ircMessage struct {
+	Raw     string
+	Tags    map[string]string
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+func (t *Twitch) encode(line string) []byte {
+	return []byte(line + "\r\n")
+}
+
+// ircUnescape unescapes a tag value, \: is ";", \s is space, \\ is "\", \r and \n
+// are CR and LF, other escaped characters are kept and a trailing backslash is dropped
+func ircUnescape(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i == len(value) {
+			break
+		}
+		switch value[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+func (t *Twitch) decode(raw []byte) ([]*ircMessage, error) {
+	var res []*ircMessage
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if line == "" {
+			continue
+		}
+		message := &ircMessage{Raw: line, Tags: map[string]string{}}
+		if strings.HasPrefix(line, "@") {
+			i := strings.Index(line, " ")
+			if i < 0 {
+				return nil, errors.New(fmt.Sprintf("invalid irc message %s", line))
+			}
+			for _, tag := range strings.Split(line[1:i], ";") {
+				kv := strings.SplitN(tag, "=", 2)
+				if len(kv) == 2 {
+					message.Tags[kv[0]] = ircUnescape(kv[1])
+				}
+			}
+			line = line[i+1:]
+		}
+		if strings.HasPrefix(line, ":") {
+			i := strings.Index(line, " ")
+			if i < 0 {
+				return nil, errors.New(fmt.Sprintf("invalid irc message %s", line))
+			}
+			message.Prefix = line[1:i]
+			line = line[i+1:]
+		}
+		// trailing param starts with " :" and may contain spaces
+		var trailing *string
+		if i := strings.Index(line, " :"); i >= 0 {
+			s := line[i+2:]
+			trailing = &s
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return nil, errors.New(fmt.Sprintf("invalid irc message %s", line))
+		}
+		message.Command = fields[0]
+		message.Params = fields[1:]
+		if trailing != nil {
+			message.Params = append(message.Params, *trailing)
+		}
+		res = append(res, message)
+	}
+	return res, nil
+}
+
+func (t *Twitch) authenticate() error {
+	lines := []string{
+		"CAP REQ :twitch.tv/tags twitch.tv/commands",
+		"PASS SCHMOOPIIE",
+		fmt.Sprintf("NICK "+TwitchNick, 10000+rand.Intn(90000)),
+		"JOIN #" + t.RoomID,
+	}
+	for _, line := range lines {
+		err := t.Dan.WriteMessage(websocket.TextMessage, t.encode(line))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Twitch) heartBeat(ctx context.Context) error {
+	defer logger.Infof("heartbeat of room %s exited", t.RoomID)
+	data := t.encode("PING :tmi.twitch.tv")
+	ticker := time.NewTicker(time.Second * 60)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := t.Dan.WriteMessage(websocket.TextMessage, data)
+			if err != nil {
+				return err
+			}
+		case pong := <-t.pong:
+			err := t.Dan.WriteMessage(websocket.TextMessage, pong)
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// handle answers pings of a frame and converts its messages to danmaku
+func (t *Twitch) handle(raw []byte) ([]*Danmaku, error) {
+	res, err := t.decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	var danmakus []*Danmaku
+	for _, message := range res {
+		switch message.Command {
+		case "PING":
+			// server closes the connection if pong is missing
+			select {
+			case t.pong <- t.encode("PONG :" + strings.Join(message.Params, " ")):
+			default:
+			}
+		case "PRIVMSG":
+			if len(message.Params) < 2 {
+				break
+			}
+			color := message.Tags["color"]
+			if color == "" {
+				color = "#ffffff"
+			}
+			timestamp, _ := strconv.ParseInt(message.Tags["tmi-sent-ts"], 10, 64)
+			raw, _ := json.Marshal(message.Raw)
+			danmakus = append(danmakus, &Danmaku{
+				Kind:      KIND_CHAT,
+				Text:      message.Params[1],
+				Color:     color,
+				Type:      DANMAKU_SCROLL,
+				UID:       message.Tags["user-id"],
+				Name:      message.Tags["display-name"],
+				Timestamp: timestamp,
+				Admin:     message.Tags["mod"] == "1",
+				Raw:       raw,
+			})
+		}
+	}
+	return danmakus, nil
+}
+
+func (t *Twitch) dial() error {
+	conn, _, err := websocket.DefaultDialer.Dial(TwitchDanmakuUrl, nil)
+	if err != nil {
+		return err
+	}
+	logger.Infof("connect to danmaku %s", t.RoomID)
+	t.Dan = conn
+	// pongs are written by heartbeat, websocket supports only one writer
+	t.pong = make(chan []byte, 1)
+	err = t.authenticate()
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (t *Twitch) serve(ctx context.Context) error {
+	return serveConn(ctx, t.Dan, t.listen(t.Dan, t.handle), t.heartBeat)
+}
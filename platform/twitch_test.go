@@ -0,0 +1,163 @@
+package platform
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestIrcUnescape(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain", "plain"},
+		{`hello\sworld`, "hello world"},
+		{`a\:b`, "a;b"},
+		{`back\\slash`, `back\slash`},
+		{`line\r\nbreak`, "line\r\nbreak"},
+		{`\\s`, `\s`},
+		{`unknown\x`, "unknownx"},
+		{`trailing\`, "trailing"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := ircUnescape(tt.value); got != tt.want {
+			t.Errorf("ircUnescape(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestTwitchDecode(t *testing.T) {
+	raw := "@badge-info=;color=#FF0000;display-name=Some\\sOne;mod=1;system-msg=a\\:b;user-id=123 " +
+		":someone!someone@someone.tmi.twitch.tv PRIVMSG #room :hello :) world\r\n" +
+		"PING :tmi.twitch.tv\r\n" +
+		":tmi.twitch.tv 001 justinfan12345 :Welcome, GLHF!\r\n"
+	res, err := (&Twitch{}).decode([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 {
+		t.Fatalf("got %d messages, want 3", len(res))
+	}
+	tags := map[string]string{
+		"badge-info":   "",
+		"color":        "#FF0000",
+		"display-name": "Some One",
+		"mod":          "1",
+		"system-msg":   "a;b",
+		"user-id":      "123",
+	}
+	if !reflect.DeepEqual(res[0].Tags, tags) {
+		t.Errorf("got tags %v, want %v", res[0].Tags, tags)
+	}
+	if res[0].Prefix != "someone!someone@someone.tmi.twitch.tv" || res[0].Command != "PRIVMSG" ||
+		!reflect.DeepEqual(res[0].Params, []string{"#room", "hello :) world"}) {
+		t.Errorf("got message %+v", res[0])
+	}
+	if res[1].Command != "PING" || !reflect.DeepEqual(res[1].Params, []string{"tmi.twitch.tv"}) {
+		t.Errorf("got ping %+v", res[1])
+	}
+	if res[2].Command != "001" || !reflect.DeepEqual(res[2].Params, []string{"justinfan12345", "Welcome, GLHF!"}) {
+		t.Errorf("got welcome %+v", res[2])
+	}
+	for _, invalid := range []string{"@tags-only", ":prefix-only", ":prefix  :trailing"} {
+		if _, err := (&Twitch{}).decode([]byte(invalid)); err == nil {
+			t.Errorf("%q decoded without error", invalid)
+		}
+	}
+}
+
+// twitchServer stands in for twitch irc, it sends lines read from the room and
+// writes lines sent to push
+func twitchServer(t *testing.T) (<-chan string, chan<- string) {
+	upgrader := websocket.Upgrader{}
+	lines := make(chan string, 16)
+	push := make(chan string, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go func() {
+			for line := range push {
+				if conn.WriteMessage(websocket.TextMessage, []byte(line+"\r\n")) != nil {
+					return
+				}
+			}
+		}()
+		for {
+			_, raw, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(string(raw), "\r\n"), "\r\n") {
+				lines <- line
+			}
+		}
+	}))
+	url := TwitchDanmakuUrl
+	TwitchDanmakuUrl = "ws" + strings.TrimPrefix(server.URL, "http")
+	t.Cleanup(func() {
+		TwitchDanmakuUrl = url
+		close(push)
+		server.Close()
+	})
+	return lines, push
+}
+
+func readLine(t *testing.T, lines <-chan string) string {
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(time.Second * 5):
+		t.Fatal("no line from room")
+	}
+	return ""
+}
+
+func TestTwitchDanmaku(t *testing.T) {
+	lines, push := twitchServer(t)
+	url, rooms := roomServer(t, roomIndex(TWITCH, "room"), func() Room {
+		room := &Twitch{RoomID: "room"}
+		room.BaseRoom = newBaseRoom(TWITCH, "room", room)
+		return room
+	})
+	client := dialDanmaku(t, url)
+	defer (<-rooms).Close()
+
+	if line := readLine(t, lines); line != "CAP REQ :twitch.tv/tags twitch.tv/commands" {
+		t.Fatalf("got %q, want CAP REQ", line)
+	}
+	if line := readLine(t, lines); line != "PASS SCHMOOPIIE" {
+		t.Fatalf("got %q, want PASS", line)
+	}
+	if line := readLine(t, lines); !strings.HasPrefix(line, "NICK justinfan") {
+		t.Fatalf("got %q, want NICK", line)
+	}
+	if line := readLine(t, lines); line != "JOIN #room" {
+		t.Fatalf("got %q, want JOIN", line)
+	}
+	push <- "PING :tmi.twitch.tv"
+	if line := readLine(t, lines); line != "PONG :tmi.twitch.tv" {
+		t.Fatalf("got %q, want PONG", line)
+	}
+
+	push <- "@color=;display-name=Some\\sOne;mod=0;tmi-sent-ts=1700000000000;user-id=123 " +
+		":someone!someone@someone.tmi.twitch.tv PRIVMSG #room :hello world"
+	var danmaku Danmaku
+	_ = client.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if err := client.ReadJSON(&danmaku); err != nil {
+		t.Fatal(err)
+	}
+	if danmaku.Kind != KIND_CHAT || danmaku.Text != "hello world" || danmaku.Name != "Some One" ||
+		danmaku.UID != "123" || danmaku.Color != "#ffffff" || danmaku.Timestamp != 1700000000000 {
+		t.Fatalf("got danmaku %+v", danmaku)
+	}
+}
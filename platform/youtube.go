@@ -0,0 +1,324 @@
+package platform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"live/util"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	YoutubeUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/84.0.4147.105 Safari/537.36"
+	// used when the chat doesn't tell when to poll next
+	YoutubePollInterval = time.Second * 5
+)
+
+// youtube urls are vars so that tests can replace them with a local server
+var (
+	YoutubeChannelUrl = "https://www.youtube.com/channel/%s/live"
+	YoutubeHandleUrl  = "https://www.youtube.com/%s/live"
+	YoutubeVideoUrl   = "https://www.youtube.com/watch?v=%s"
+	YoutubeChatUrl    = "https://www.youtube.com/live_chat?is_popout=1&v=%s"
+	YoutubePollUrl    = "https://www.youtube.com/youtubei/v1/live_chat/get_live_chat?key=%s"
+)
+
+var (
+	YoutubePlayerRe        = regexp.MustCompile(`ytInitialPlayerResponse\s*=\s*\{`)
+	YoutubeDataRe          = regexp.MustCompile(`ytInitialData"?\]?\s*=\s*\{`)
+	YoutubeApiKeyRe        = regexp.MustCompile(`"INNERTUBE_API_KEY"\s*:\s*"([^"]+)"`)
+	YoutubeClientVersionRe = regexp.MustCompile(`"INNERTUBE_CONTEXT_CLIENT_VERSION"\s*:\s*"([^"]+)"`)
+	YoutubeChannelIDRe     = regexp.MustCompile(`^UC[\w-]{22}$`)
+	YoutubeHandleRe        = regexp.MustCompile(`^@[\w.-]+$`)
+)
+
+const YOUTUBE Type = 6
+
+var YoutubeRoomUrlRe = regexp.MustCompile(`^(?:(?:www\.|m\.)?youtube\.com/(?:(?:watch\?(?:.*&)?v=|live/|channel/)([\w-]+)|(@[\w.-]+))|youtu\.be/([\w-]+))`)
+
+func init() {
+	Register(&Adapter{
+		Type:         YOUTUBE,
+		Name:         "youtube",
+		Capabilities: Capabilities{Danmaku: true, Raw: true},
+		URL:          YoutubeRoomUrlRe,
+		New:          GetYoutubeRoom,
+	})
+}
+
+type Youtube struct {
+	*BaseRoom
+	RoomID  string
+	Quality uint
+	Status  int
+	// live video of the room
+	videoID string
+	player  gjson.Result
+	// live chat polling state
+	apiKey        string
+	clientVersion string
+	continuation  string
+}
+
+// GetYoutubeRoom accepts a channel id, a @handle or a video id, channels are resolved to their
+// current live video. danmaku rooms are indexed by the video so that a channel and its video share one
+func GetYoutubeRoom(id string, quality uint, client *websocket.Conn) (Room, error) {
+	page := fmt.Sprintf(YoutubeVideoUrl, id)
+	channel := true
+	switch {
+	case YoutubeChannelIDRe.MatchString(id):
+		page = fmt.Sprintf(YoutubeChannelUrl, id)
+	case YoutubeHandleRe.MatchString(id):
+		page = fmt.Sprintf(YoutubeHandleUrl, id)
+	default:
+		channel = false
+	}
+	html, err := util.Request("GET", page, "", map[string]string{
+		"User-Agent":      YoutubeUserAgent,
+		"Accept-Language": "en-US",
+	})
+	if err != nil {
+		return nil, err
+	}
+	player, err := pageJSON(html, YoutubePlayerRe)
+	if err != nil {
+		return nil, err
+	}
+	// channels without live stream show the channel page
+	videoID := player.Get("videoDetails.videoId").String()
+	if videoID == "" && !channel {
+		return nil, errors.New(fmt.Sprintf("room %s not found", id))
+	}
+	status := 0
+	if player.Get("videoDetails.isLive").Bool() {
+		status = 1
+	}
+	if client == nil {
+		return &Youtube{
+			RoomID:  id,
+			Quality: quality,
+			Status:  status,
+			videoID: videoID,
+			player:  player,
+		}, nil
+	}
+	if status != 1 {
+		return nil, errors.New(fmt.Sprintf("room %s is not living", id))
+	}
+	return joinRoom(roomIndex(YOUTUBE, videoID), func() Room {
+		room := &Youtube{
+			RoomID:  videoID,
+			videoID: videoID,
+		}
+		room.BaseRoom = newBaseRoom(YOUTUBE, videoID, room)
+		return room
+	}, client), nil
+}
+
+func (y *Youtube) GetLiveInfo() (*Platform, error) {
+	if y.Status != 1 {
+		return &Platform{
+			Type:           YOUTUBE,
+			RoomID:         y.RoomID,
+			Status:         0,
+			CurrentQuality: y.Quality,
+			Title:          y.player.Get("videoDetails.title").String(),
+		}, nil
+	}
+	manifest := y.player.Get("streamingData.hlsManifestUrl").String()
+	if manifest == "" {
+		return nil, errors.New(fmt.Sprintf("no stream found in room %s", y.RoomID))
+	}
+	playlist, err := util.Request("GET", manifest, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	variants := parseMasterPlaylist(playlist)
+	if len(variants) == 0 {
+		return nil, errors.New(fmt.Sprintf("no stream found in room %s", y.RoomID))
+	}
+	// quality is the bandwidth of variant, the highest one is the default
+	var qualities []Quality
+	best, current := variants[0], -1
+	for i, variant := range variants {
+		qualities = append(qualities, Quality{
+			Quality:     variant.Bandwidth,
+			Description: variant.Name,
+		})
+		if variant.Bandwidth > best.Bandwidth {
+			best = variant
+		}
+		if uint64(y.Quality) == variant.Bandwidth {
+			current = i
+		}
+	}
+	if current >= 0 {
+		best = variants[current]
+	}
+	return &Platform{
+		Type:           YOUTUBE,
+		RoomID:         y.RoomID,
+		Status:         uint(y.Status),
+		CurrentQuality: uint(best.Bandwidth),
+		Link:           best.Url,
+		Qualities:      qualities,
+		Title:          y.player.Get("videoDetails.title").String(),
+	}, nil
+}
+
+// youtube live chat is polled with continuation tokens instead of pushed,
+// every response carries the next continuation and how long to wait for it
+// source: https://github.com/taizan-hokuto/pytchat
+func (y *Youtube) encode(continuation string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"context": map[string]interface{}{
+			"client": map[string]interface{}{
+				"clientName":    "WEB",
+				"clientVersion": y.clientVersion,
+			},
+		},
+		"continuation": continuation,
+	})
+}
+
+// decode returns chat messages, the next continuation and the poll timeout
+func (y *Youtube) decode(raw []byte) ([]gjson.Result, string, time.Duration, error) {
+	data := gjson.ParseBytes(raw)
+	chat := data.Get("continuationContents.liveChatContinuation")
+	if !chat.Exists() {
+		return nil, "", 0, errors.New(fmt.Sprintf("live chat of room %s ended", y.RoomID))
+	}
+	var continuation string
+	var timeout time.Duration
+	chat.Get("continuations.0").ForEach(func(key, value gjson.Result) bool {
+		continuation = value.Get("continuation").String()
+		timeout = time.Duration(value.Get("timeoutMs").Int()) * time.Millisecond
+		return false
+	})
+	var res []gjson.Result
+	chat.Get("actions").ForEach(func(key, value gjson.Result) bool {
+		message := value.Get("addChatItemAction.item.liveChatTextMessageRenderer")
+		if message.Exists() {
+			res = append(res, message)
+		}
+		return true
+	})
+	return res, continuation, timeout, nil
+}
+
+// authenticate reads the api key and the first continuation from chat page
+func (y *Youtube) authenticate() error {
+	html, err := util.Request("GET", fmt.Sprintf(YoutubeChatUrl, y.videoID), "", map[string]string{
+		"User-Agent": YoutubeUserAgent,
+	})
+	if err != nil {
+		return err
+	}
+	key := YoutubeApiKeyRe.FindSubmatch(html)
+	version := YoutubeClientVersionRe.FindSubmatch(html)
+	if len(key) == 0 || len(version) == 0 {
+		return errors.New(fmt.Sprintf("live chat of room %s not found", y.RoomID))
+	}
+	y.apiKey, y.clientVersion = string(key[1]), string(version[1])
+	data, err := pageJSON(html, YoutubeDataRe)
+	if err != nil {
+		return err
+	}
+	data.Get("contents.liveChatRenderer.continuations.0").ForEach(func(key, value gjson.Result) bool {
+		y.continuation = value.Get("continuation").String()
+		return false
+	})
+	if y.continuation == "" {
+		return errors.New(fmt.Sprintf("live chat of room %s not found", y.RoomID))
+	}
+	return nil
+}
+
+// youtubeText joins text and emoji runs of a message
+func youtubeText(message gjson.Result) string {
+	var text strings.Builder
+	message.Get("message.runs").ForEach(func(key, value gjson.Result) bool {
+		if value.Get("text").Exists() {
+			text.WriteString(value.Get("text").String())
+		} else {
+			text.WriteString(value.Get("emoji.shortcuts.0").String())
+		}
+		return true
+	})
+	return text.String()
+}
+
+// listener polls live chat, there is no heartbeat since no connection is kept
+func (y *Youtube) listener(ctx context.Context) error {
+	defer logger.Infof("listener of room %s exited", y.RoomID)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			body, err := y.encode(y.continuation)
+			if err != nil {
+				return err
+			}
+			raw, err := util.Request("POST", fmt.Sprintf(YoutubePollUrl, y.apiKey), string(body), map[string]string{
+				"User-Agent":   YoutubeUserAgent,
+				"Content-Type": "application/json",
+			})
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				// poll again later, a failed request doesn't consume the continuation
+				logger.Error(err)
+				timer.Reset(YoutubePollInterval)
+				break
+			}
+			res, continuation, timeout, err := y.decode(raw)
+			if err != nil {
+				return err
+			}
+			if continuation != "" {
+				y.continuation = continuation
+			}
+			if timeout <= 0 {
+				timeout = YoutubePollInterval
+			}
+			timer.Reset(timeout)
+			logger.Debugf("room id %s clients %d", y.RoomID, y.Clients.Len())
+			for _, message := range res {
+				y.Send(&Danmaku{
+					Kind:      KIND_CHAT,
+					Text:      youtubeText(message),
+					Color:     "#ffffff",
+					Type:      DANMAKU_SCROLL,
+					UID:       message.Get("authorExternalChannelId").String(),
+					Name:      message.Get("authorName.simpleText").String(),
+					Timestamp: message.Get("timestampUsec").Int() / 1000,
+					Raw:       json.RawMessage(message.Raw),
+				})
+			}
+		}
+	}
+}
+
+// dial reads the chat page again, a new continuation is needed after chat broken
+func (y *Youtube) dial() error {
+	err := y.authenticate()
+	if err != nil {
+		return err
+	}
+	logger.Infof("connect to danmaku %s", y.RoomID)
+	return nil
+}
+
+// serve runs only the poller, there is no connection to close
+func (y *Youtube) serve(ctx context.Context) error {
+	return serveConn(ctx, nil, y.listener)
+}
@@ -0,0 +1,167 @@
+package platform
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// youtubeServer stands in for youtube live chat, it serves the chat page and replays
+// continuation responses in testdata, continuations asked for are sent to polls.
+// the responses are reconstructed from the layout of get_live_chat with short timeouts
+func youtubeServer(t *testing.T) <-chan string {
+	page := fixture(t, "youtube_chat.html")
+	responses := map[string][]byte{
+		"continuation-1": fixture(t, "youtube_continuation_1.json"),
+		"continuation-2": fixture(t, "youtube_continuation_2.json"),
+		"continuation-3": fixture(t, "youtube_continuation_end.json"),
+	}
+	polls := make(chan string, 16)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live_chat", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("v") != "VIDEO_ID" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(page)
+	})
+	mux.HandleFunc("/youtubei/v1/live_chat/get_live_chat", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Context struct {
+				Client struct {
+					ClientVersion string `json:"clientVersion"`
+				} `json:"client"`
+			} `json:"context"`
+			Continuation string `json:"continuation"`
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		if json.Unmarshal(data, &body) != nil || r.URL.Query().Get("key") != "AIzaTestKey" ||
+			body.Context.Client.ClientVersion != "2.20231101.00.00" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		polls <- body.Continuation
+		_, _ = w.Write(responses[body.Continuation])
+	})
+	server := httptest.NewServer(mux)
+	chatUrl, pollUrl := YoutubeChatUrl, YoutubePollUrl
+	YoutubeChatUrl = server.URL + "/live_chat?is_popout=1&v=%s"
+	YoutubePollUrl = server.URL + "/youtubei/v1/live_chat/get_live_chat?key=%s"
+	t.Cleanup(func() {
+		YoutubeChatUrl, YoutubePollUrl = chatUrl, pollUrl
+		server.Close()
+	})
+	return polls
+}
+
+func TestYoutubeDanmaku(t *testing.T) {
+	polls := youtubeServer(t)
+	url, rooms := roomServer(t, roomIndex(YOUTUBE, "VIDEO_ID"), func() Room {
+		room := &Youtube{RoomID: "VIDEO_ID", videoID: "VIDEO_ID"}
+		room.BaseRoom = newBaseRoom(YOUTUBE, "VIDEO_ID", room)
+		return room
+	})
+	client := dialDanmaku(t, url)
+	room := <-rooms
+
+	want := []Danmaku{
+		{Kind: KIND_CHAT, Text: "hello :wave:", Name: "viewer", UID: "UCviewer0000000000000000", Timestamp: 1700000000123},
+		{Kind: KIND_CHAT, Text: "second message", Name: "another viewer", UID: "UCanother000000000000000", Timestamp: 1700000001000},
+	}
+	for _, w := range want {
+		var danmaku Danmaku
+		_ = client.SetReadDeadline(time.Now().Add(time.Second * 5))
+		if err := client.ReadJSON(&danmaku); err != nil {
+			t.Fatal(err)
+		}
+		if danmaku.Kind != w.Kind || danmaku.Text != w.Text || danmaku.Name != w.Name ||
+			danmaku.UID != w.UID || danmaku.Timestamp != w.Timestamp {
+			t.Errorf("got danmaku %+v, want %+v", danmaku, w)
+		}
+	}
+	for _, continuation := range []string{"continuation-1", "continuation-2", "continuation-3"} {
+		select {
+		case got := <-polls:
+			if got != continuation {
+				t.Fatalf("polled %s, want %s", got, continuation)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("%s not polled", continuation)
+		}
+	}
+	// the room is closed after chat ended since youtube doesn't reconnect
+	deadline := time.Now().Add(time.Second * 5)
+	for !room.IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("room not closed after chat ended")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// a channel, its handle and its live video join the danmaku room of the video
+func TestYoutubeRoomIndex(t *testing.T) {
+	const channelID = "UCchannel000000000000000"
+	page := []byte(`<script>var ytInitialPlayerResponse = {"videoDetails":{"videoId":"VIDEO_ID","title":"live","isLive":true}};</script>`)
+	mux := http.NewServeMux()
+	for _, path := range []string{"/channel/" + channelID + "/live", "/@handle/live", "/watch"} {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/watch" && r.URL.Query().Get("v") != "VIDEO_ID" {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write(page)
+		})
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	channelUrl, handleUrl, videoUrl := YoutubeChannelUrl, YoutubeHandleUrl, YoutubeVideoUrl
+	YoutubeChannelUrl = server.URL + "/channel/%s/live"
+	YoutubeHandleUrl = server.URL + "/%s/live"
+	YoutubeVideoUrl = server.URL + "/watch?v=%s"
+	defer func() {
+		YoutubeChannelUrl, YoutubeHandleUrl, YoutubeVideoUrl = channelUrl, handleUrl, videoUrl
+	}()
+
+	upgrader := websocket.Upgrader{}
+	rooms := make(chan Room, 3)
+	danmaku := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		room, err := GetYoutubeRoom(r.URL.Query().Get("id"), 0, conn)
+		if err != nil {
+			_ = conn.Close()
+			rooms <- nil
+			return
+		}
+		rooms <- room
+	}))
+	defer danmaku.Close()
+	var room Room
+	for _, id := range []string{channelID, "@handle", "VIDEO_ID"} {
+		dialDanmaku(t, "ws"+strings.TrimPrefix(danmaku.URL, "http")+"?id="+url.QueryEscape(id))
+		got := <-rooms
+		if got == nil {
+			t.Fatalf("%s: no room", id)
+		}
+		if room == nil {
+			room = got
+			defer room.Close()
+		}
+		if got != room || got.(*Youtube).RoomID != "VIDEO_ID" {
+			t.Errorf("%s: joined room %+v, want the room of VIDEO_ID", id, got)
+		}
+	}
+	if hub.Get(roomIndex(YOUTUBE, "VIDEO_ID")) != room {
+		t.Error("room is not indexed by video id")
+	}
+}
@@ -32,3 +32,37 @@ func Request(method, url, params string, headers map[string]string) ([]byte, err
 	}
 	return b, nil
 }
+
+// Cookies requests url and returns cookies set by the response
+func Cookies(url string, headers map[string]string) ([]*http.Cookie, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return resp.Cookies(), nil
+}
+
+// Location requests url and returns the url redirected to, it's url itself if not redirected
+func Location(url string, headers map[string]string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return resp.Request.URL.String(), nil
+}
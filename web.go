@@ -14,9 +14,21 @@ var upgrader = websocket.Upgrader{
 }
 
 type room struct {
-	Platform platform.Type `form:"platform"`
-	RoomID   uint          `form:"roomID"`
-	Quality  uint          `form:"quality"`
+	// type number or name of platform, it can be omitted if room id is a url
+	Platform string `form:"platform"`
+	// room id or live room url
+	RoomID  string `form:"roomID"`
+	Quality uint   `form:"quality"`
+	// preferred stream like "http_hls", "fmp4" and "hevc", only some platforms support it
+	Protocol string `form:"protocol"`
+	Format   string `form:"format"`
+	Codec    string `form:"codec"`
+	// rank links by latency, it takes up to a few seconds
+	Probe bool `form:"probe"`
+	// send original platform messages with danmaku
+	Raw bool `form:"raw"`
+	// what to do when the client is too slow, it only applies to the client
+	Policy platform.QueuePolicy `form:"policy"`
 }
 
 func NewServer() *gin.Engine {
@@ -25,6 +37,9 @@ func NewServer() *gin.Engine {
 	{
 		api.GET("/live", RoomInfo)
 		api.GET("/danmaku", Danmaku)
+		api.GET("/resolve", Resolve)
+		api.GET("/metrics", Metrics)
+		api.GET("/platforms", Platforms)
 	}
 	return r
 }
@@ -40,7 +55,20 @@ func RoomInfo(ctx *gin.Context) {
 		})
 		return
 	}
-	info, err := platform.InitRoom(r.Platform, r.RoomID, r.Quality)
+	t, roomID, err := platform.ResolveRoom(r.Platform, r.RoomID)
+	if err != nil {
+		logger.Error(err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg":  err.Error(),
+			"data": nil,
+		})
+		return
+	}
+	info, err := platform.InitRoom(t, roomID, r.Quality, r.Probe, platform.StreamPreference{
+		Protocol: r.Protocol,
+		Format:   r.Format,
+		Codec:    r.Codec,
+	})
 	if err != nil {
 		logger.Error(err)
 		ctx.JSON(http.StatusBadRequest, gin.H{
@@ -67,10 +95,57 @@ func Danmaku(ctx *gin.Context) {
 		})
 		return
 	}
+	t, roomID, err := platform.ResolveRoom(r.Platform, r.RoomID)
+	if err != nil {
+		logger.Error(err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg":  err.Error(),
+			"data": nil,
+		})
+		return
+	}
+	if r.Policy != "" && !r.Policy.Valid() {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg":  "unknown policy " + string(r.Policy),
+			"data": nil,
+		})
+		return
+	}
 	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
 	if err != nil {
 		logger.Error(err)
 		return
 	}
-	platform.InitDanmaku(r.Platform, r.RoomID, conn)
+	platform.InitDanmaku(t, roomID, conn, r.Raw, r.Policy)
+}
+
+// Resolve returns platform and room id of a live room url
+func Resolve(ctx *gin.Context) {
+	resolved, err := platform.Resolve(ctx.Query("url"))
+	if err != nil {
+		logger.Error(err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg":  err.Error(),
+			"data": nil,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg":  "success",
+		"data": resolved,
+	})
+}
+
+func Metrics(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg":  "success",
+		"data": platform.Metrics(),
+	})
+}
+
+func Platforms(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg":  "success",
+		"data": platform.Adapters(),
+	})
 }